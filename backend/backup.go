@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// BackupDestination is an additional storage that every original of a card is mirrored to,
+// such as a second disk, a second NFS path or a bucket.
+type BackupDestination struct {
+	Name string `json:"name"` // Identifies the copy in job records
+	StorageConfig
+}
+
+// namedStorage is an opened backup destination.
+type namedStorage struct {
+	Name string
+	Storage
+}
+
+// requiredCopies returns the number of verified copies a file needs before it is cleared from the card.
+// It defaults to the archive and every backup destination.
+func (sdCard SDCard) requiredCopies() int {
+	if sdCard.RequiredCopies == 0 {
+		return 1 + len(sdCard.Backups)
+	}
+	return sdCard.RequiredCopies
+}
+
+// backupStorages opens the backup destinations of the card.
+func (sdCard SDCard) backupStorages() ([]namedStorage, error) {
+	var storages []namedStorage
+	for _, backup := range sdCard.Backups {
+		storage, err := newStorage(backup.StorageConfig, "") // validateBackups requires a root for local backups
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backup destination %s: %v", backup.Name, err)
+		}
+		storages = append(storages, namedStorage{backup.Name, storage})
+	}
+	return storages, nil
+}
+
+// validateBackups checks the backup destinations and the required number of copies of a card.
+// paths are the folders of the configuration the card belongs to.
+func validateBackups(label string, sdCard SDCard, paths Paths) error {
+	names := make(map[string]bool)
+	for _, backup := range sdCard.Backups {
+		if backup.Name == "" {
+			return fmt.Errorf("backup destination for %s needs a name", label)
+		}
+		if names[backup.Name] {
+			return fmt.Errorf("duplicate backup destination %s for %s", backup.Name, label)
+		}
+		names[backup.Name] = true
+
+		if (backup.Type == "" || backup.Type == StorageLocal) && backup.Root == "" {
+			return fmt.Errorf("local backup destination %s for %s needs a root", backup.Name, label)
+		}
+		if backup.Root != "" && filepath.Clean(backup.Root) == filepath.Clean(paths.ArchiveRoot) {
+			return fmt.Errorf("backup destination %s for %s is the archive root", backup.Name, label)
+		}
+		if err := validateStorage(backup.StorageConfig); err != nil {
+			return fmt.Errorf("invalid backup destination %s for %s: %v", backup.Name, label, err)
+		}
+	}
+	if sdCard.RequiredCopies < 0 || sdCard.RequiredCopies > 1+len(sdCard.Backups) {
+		return fmt.Errorf("required copies for %s must be between 1 and %d", label, 1+len(sdCard.Backups))
+	}
+	return nil
+}
+
+// mirrorFile copies a file from the card to every backup destination that does not hold a verified copy yet,
+// under the same name as the archived original. A copy is only verified when the digest of what the backup
+// stored matches the archived original. Failures are logged and leave the file on the card.
+func mirrorFile(sdCard SDCard, job *IngestJob, backups []namedStorage, sourcePath string, file *FileProgress) error {
+	logger := logReceiver.WithJob(job).WithFile(sourcePath)
+	key, err := currentSettings().archiveKey(file.Destination)
+	if err != nil {
+		return err
+	}
+
+	for _, backup := range backups {
+		if existing := file.Backups[backup.Name]; existing != nil && existing.Verified {
+			if stored, err := backup.Stat(key); err == nil && stored.Size == file.Size {
+				continue
+			}
+		}
+
+		progress := copyProgressReporter(sdCard.Name, sourcePath, file.Size)
+		digest, err := storeFile(devices.Context(job.Label), backup, sourcePath, key, file.Size, progress)
+		if err != nil {
+			logReceiver.Progress(ProgressEvent{Kind: "copy", File: sourcePath, Device: sdCard.Name, Done: true, Failed: true})
+			if devices.Aborted(job.Label) {
+				return err
+			}
+			logger.WithField("backup", backup.Name).Error("Error mirroring %s to backup %s: %v", sourcePath, backup.Name, err)
+			continue
+		}
+		backupCopy := &BackupCopy{Location: backup.Location(key), SHA256: digest, Verified: digest == file.SHA256}
+		if backupCopy.Verified {
+			logger.WithField("backup", backup.Name).Info("Mirrored and verified file: %s to %s", sourcePath, backupCopy.Location)
+		} else {
+			logger.WithField("backup", backup.Name).Error("Copy of %s at %s does not match the archived original", sourcePath, backupCopy.Location)
+		}
+
+		err = jobStore.Update(job, func(job *IngestJob) {
+			record := job.Files[sourcePath]
+			if record.Backups == nil {
+				record.Backups = make(map[string]*BackupCopy)
+			}
+			record.Backups[backup.Name] = backupCopy
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record backup of %s: %v", sourcePath, err)
+		}
+	}
+	return nil
+}
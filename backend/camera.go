@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CameraProfile is a preset for a family of cameras, selected with "profile" on an SDCard.
+// Settings on the SDCard itself take precedence over the ones of its profile.
+type CameraProfile struct {
+	Description       string            `json:"description,omitempty"`
+	SourceDirs        []string          `json:"sourceDirs,omitempty"`        // Folders relative to the card root that hold footage
+	IgnoredExtensions []string          `json:"ignoredExtensions,omitempty"` // Sidecar files that are not imported, on top of the global list
+	RenameExtensions  map[string]string `json:"renameExtensions,omitempty"`  // Extensions changed on import, e.g. ".insv" to ".mp4"
+	ProxyProfiles     []string          `json:"proxyProfiles,omitempty"`     // Proxy profiles rendered when the card selects none
+}
+
+// builtinCameraProfiles are the presets shipped with the processor. The cameraProfiles section of the configuration
+// can add presets or replace these by name.
+var builtinCameraProfiles = map[string]CameraProfile{
+	"sony-xavc": {
+		Description:       "Sony XAVC S / XAVC HS (Alpha, ZV, FX)",
+		SourceDirs:        []string{"PRIVATE/M4ROOT/CLIP"},
+		IgnoredExtensions: []string{".XML"}, // Per-clip metadata next to every MP4
+		ProxyProfiles:     []string{defaultProxyProfileName},
+	},
+	"dji": {
+		Description:       "DJI Osmo, Osmo Action and Pocket",
+		SourceDirs:        []string{"DCIM/DJI_*", "DCIM/*MEDIA"},
+		IgnoredExtensions: []string{".LRF"}, // Low resolution previews
+		ProxyProfiles:     []string{defaultProxyProfileName},
+	},
+	"insta360": {
+		Description:       "Insta360 GO and X series",
+		SourceDirs:        []string{"DCIM/Camera01"},
+		IgnoredExtensions: []string{".LRV"},
+		RenameExtensions:  map[string]string{".insv": ".mp4"}, // INSV is MP4 with a 360 metadata track
+		ProxyProfiles:     []string{defaultProxyProfileName},
+	},
+	"gopro": {
+		Description:       "GoPro HERO",
+		SourceDirs:        []string{"DCIM/*GOPRO"},
+		IgnoredExtensions: []string{".LRV", ".THM"},
+		ProxyProfiles:     []string{defaultProxyProfileName},
+	},
+	"bambu": {
+		Description:   "Bambu Lab printer timelapses",
+		SourceDirs:    []string{"timelapse"},
+		ProxyProfiles: []string{defaultProxyProfileName},
+	},
+	"canon": {
+		Description:       "Canon EOS and PowerShot",
+		SourceDirs:        []string{"DCIM/*CANON"},
+		IgnoredExtensions: []string{".THM"},
+		ProxyProfiles:     []string{defaultProxyProfileName},
+	},
+	"panasonic": {
+		Description:       "Panasonic Lumix",
+		SourceDirs:        []string{"DCIM/*_PANA", "PRIVATE/AVCHD/BDMV/STREAM"},
+		IgnoredExtensions: []string{".XML"},
+		ProxyProfiles:     []string{defaultProxyProfileName},
+	},
+}
+
+// lookupCameraProfile returns the configured or built-in camera profile with the given name.
+func (s *Settings) lookupCameraProfile(name string) (CameraProfile, bool) {
+	if profile, exists := s.cameraProfiles[name]; exists {
+		return profile, true
+	}
+	profile, exists := builtinCameraProfiles[name]
+	return profile, exists
+}
+
+// allCameraProfiles returns the built-in camera profiles overlaid with the configured ones.
+func (s *Settings) allCameraProfiles() map[string]CameraProfile {
+	all := make(map[string]CameraProfile, len(builtinCameraProfiles)+len(s.cameraProfiles))
+	for name, profile := range builtinCameraProfiles {
+		all[name] = profile
+	}
+	for name, profile := range s.cameraProfiles {
+		all[name] = profile
+	}
+	return all
+}
+
+// camera returns the camera profile of the card, or an empty profile when it has none.
+func (sdCard SDCard) camera() CameraProfile {
+	if sdCard.Profile == "" {
+		return CameraProfile{}
+	}
+	profile, _ := currentSettings().lookupCameraProfile(sdCard.Profile) // Unknown profiles are rejected when the configuration is saved
+	return profile
+}
+
+// sourceDirs returns the folders of the card to import, falling back to the ones of its camera profile.
+func (sdCard SDCard) sourceDirs() []string {
+	if len(sdCard.SourceDirs) > 0 {
+		return sdCard.SourceDirs
+	}
+	return sdCard.camera().SourceDirs
+}
+
+// legacyRenameExtensions are the renames applied to every card before camera profiles existed.
+// Cards without a profile keep them, so their imports are named as they always were.
+var legacyRenameExtensions = map[string]string{".insv": ".mp4"}
+
+// importName returns the name a file is imported under, applying the rename rules of the camera profile.
+func (sdCard SDCard) importName(fileName string) string {
+	renames := sdCard.camera().RenameExtensions
+	if sdCard.Profile == "" {
+		renames = legacyRenameExtensions
+	}
+	lowerFileName := strings.ToLower(fileName)
+	for from, to := range renames {
+		if strings.HasSuffix(lowerFileName, strings.ToLower(from)) {
+			return fileName[:len(fileName)-len(from)] + to
+		}
+	}
+	return fileName
+}
+
+// validateCameraProfiles checks the camera profiles of a configuration and the profile references of its cards.
+func validateCameraProfiles(config Config) error {
+	exists := func(name string) bool {
+		_, configured := config.CameraProfiles[name]
+		_, builtin := builtinCameraProfiles[name]
+		return configured || builtin
+	}
+	for name, profile := range config.CameraProfiles {
+		for from := range profile.RenameExtensions {
+			if !strings.HasPrefix(from, ".") {
+				return fmt.Errorf("camera profile %s renames %s, extensions must start with a dot", name, from)
+			}
+		}
+		for _, proxy := range profile.ProxyProfiles {
+			if _, configured := config.ProxyProfiles[proxy]; !configured && proxy != defaultProxyProfileName {
+				return fmt.Errorf("unknown proxy profile %s in camera profile %s", proxy, name)
+			}
+		}
+	}
+	for label, sdCard := range config.SDCardMappings {
+		if sdCard.Profile != "" && !exists(sdCard.Profile) {
+			return fmt.Errorf("unknown camera profile %s for %s", sdCard.Profile, label)
+		}
+		if sdCard.Profile == "" && len(sdCard.SourceDirs) == 0 {
+			return fmt.Errorf("%s needs sourceDirs or a camera profile", label)
+		}
+	}
+	return nil
+}
+
+// cameraSourceDirs returns the source folders of every camera profile, sorted and without duplicates.
+func cameraSourceDirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, profile := range currentSettings().allCameraProfiles() {
+		for _, dir := range profile.SourceDirs {
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestImportName(t *testing.T) {
+	tests := []struct {
+		profile string
+		name    string
+		want    string
+	}{
+		{"", "VID_20240501_0001.insv", "VID_20240501_0001.mp4"}, // Cards without a profile keep the legacy rename
+		{"insta360", "VID_20240501_0001.INSV", "VID_20240501_0001.mp4"},
+		{"gopro", "GX010001.insv", "GX010001.insv"},
+		{"", "DJI_0001.MP4", "DJI_0001.MP4"},
+	}
+	for _, test := range tests {
+		if got := (SDCard{Profile: test.profile}).importName(test.name); got != test.want {
+			t.Errorf("profile %q imports %s as %s, want %s", test.profile, test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Collision strategies for SDCard.CollisionStrategy, used when a file with the same name already exists at the destination.
+// A job that is resumed reuses the names it recorded before copying, so no strategy duplicates a file it stored itself.
+const (
+	CollisionSkipIdentical = "skip-identical" // Skip identical files, rename others with a numeric suffix (default)
+	CollisionSuffix        = "suffix"         // Always rename with a numeric suffix
+	CollisionTimestamp     = "timestamp"      // Rename using the capture timestamp of the file
+)
+
+// collisionStrategy returns the effective collision strategy of the card.
+func (sdCard SDCard) collisionStrategy() string {
+	if sdCard.CollisionStrategy == "" {
+		return CollisionSkipIdentical
+	}
+	return sdCard.CollisionStrategy
+}
+
+// validCollisionStrategy reports whether strategy is a known collision strategy. An empty strategy means the default.
+func validCollisionStrategy(strategy string) bool {
+	switch strategy {
+	case "", CollisionSkipIdentical, CollisionSuffix, CollisionTimestamp:
+		return true
+	}
+	return false
+}
+
+// resolveCollision decides the name a source file is copied to in destDir.
+// It returns the destination file name, and the digest of the existing file when an identical copy is already present.
+// A name counts as taken when either the original or one of its proxies exists, so the proxies always follow the chosen name.
+func resolveCollision(sdCard SDCard, sourcePath, destDir, name string, source os.FileInfo, captured time.Time) (string, string, error) {
+	if !nameTaken(destDir, name) {
+		return name, "", nil
+	}
+
+	strategy := sdCard.collisionStrategy()
+	if strategy == CollisionSkipIdentical {
+		existing, digest, err := identicalOriginal(sourcePath, destDir, name, source)
+		if err != nil {
+			return "", "", err
+		}
+		if digest != "" {
+			logReceiver.WithDevice(sdCard.Name).WithFile(sourcePath).Info("Skipping %s: identical file already exists at %s", sourcePath, filepath.Join(destDir, existing))
+			return existing, digest, nil
+		}
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	first := 1
+	if strategy == CollisionTimestamp {
+		base = fmt.Sprintf("%s_%s", base, captured.In(currentSettings().timezone).Format("20060102-150405"))
+		first = 0 // Try the timestamped name before adding a number
+	}
+
+	for i := first; ; i++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if i == 0 {
+			candidate = base + ext
+		}
+		if !nameTaken(destDir, candidate) {
+			logReceiver.WithDevice(sdCard.Name).WithFile(sourcePath).Warn("Name collision for %s in %s, copying as %s", name, destDir, candidate)
+			return candidate, "", nil
+		}
+	}
+}
+
+// identicalOriginal looks for a copy of the source in destDir under the given name or one of its numbered variants,
+// as an earlier import may have renamed the same file already.
+// It returns the name and digest of the copy, or "" when the skip-identical strategy would copy the source.
+func identicalOriginal(sourcePath, destDir, name string, source os.FileInfo) (string, string, error) {
+	identity := &sourceIdentity{path: sourcePath, size: source.Size()}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+		}
+		if !nameTaken(destDir, candidate) {
+			return "", "", nil
+		}
+		digest, err := identity.matches(destDir, candidate)
+		if err != nil || digest != "" {
+			return candidate, digest, err
+		}
+	}
+}
+
+// sourceIdentity compares a source file with stored originals. The source is hashed at most once,
+// and only when a stored original of the same size is found.
+type sourceIdentity struct {
+	path   string
+	size   int64
+	digest string
+}
+
+// matches returns the digest of the original with the given name in destDir when it is a copy of the source, or "".
+func (s *sourceIdentity) matches(destDir, name string) (string, error) {
+	existing, err := currentSettings().statOriginal(filepath.Join(destDir, name))
+	if err != nil || existing.Size != s.size {
+		return "", nil
+	}
+	existingDigest, err := storedDigest(destDir, name)
+	if err != nil || existingDigest == "" {
+		return "", err
+	}
+	if s.digest == "" {
+		if s.digest, _, err = hashFile(s.path); err != nil {
+			return "", err
+		}
+	}
+	if existingDigest != s.digest {
+		return "", nil
+	}
+	return existingDigest, nil
+}
+
+// storedDigest returns the digest of the original with the given name in destDir. Originals on disk are hashed,
+// for other storages the digest recorded in the manifest is used. It returns "" when the digest is unknown.
+func storedDigest(destDir, name string) (string, error) {
+	if localPath, ok := currentSettings().localOriginalPath(filepath.Join(destDir, name)); ok {
+		digest, _, err := hashFile(localPath)
+		return digest, err
+	}
+	entries, err := readManifest(destDir)
+	if err != nil {
+		return "", nil
+	}
+	return entries[name], nil
+}
+
+// nameTaken reports whether an original or a proxy of any profile with the given name exists in destDir.
+func nameTaken(destDir, name string) bool {
+	originalPath := filepath.Join(destDir, name)
+	if currentSettings().originalExists(originalPath) {
+		return true
+	}
+	for _, profile := range allProxyProfiles() {
+		if verifyFileExists(proxyPathFor(originalPath, profile)) {
+			return true
+		}
+	}
+	return verifyFileExists(legacyProxyPath(originalPath))
+}
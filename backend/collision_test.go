@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestArchive points the archive root and the originals at a temporary folder for the duration of the test.
+func useTestArchive(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	useTestSettings(t, func(settings *Settings) {
+		settings.paths.ArchiveRoot = root
+		settings.originals = &localStorage{root: root}
+	})
+	return root
+}
+
+func writeTestFile(t *testing.T, path, content string) os.FileInfo {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestResolveCollisionSkipsIdenticalFile(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "GX010001.MP4")
+	info := writeTestFile(t, source, "footage")
+	destDir := filepath.Join(useTestArchive(t), "GOPRO")
+	writeTestFile(t, filepath.Join(destDir, "GX010001.MP4"), "footage")
+
+	name, digest, err := resolveCollision(SDCard{Name: "GOPRO"}, source, destDir, "GX010001.MP4", info, info.ModTime())
+	if err != nil || name != "GX010001.MP4" || digest == "" {
+		t.Fatalf("got %s, digest %q, %v", name, digest, err)
+	}
+
+	// A copy an earlier import stored under a suffixed name is found as well
+	writeTestFile(t, filepath.Join(destDir, "GX010001.MP4"), "another")
+	writeTestFile(t, filepath.Join(destDir, "GX010001_1.MP4"), "footage")
+	name, digest, err = resolveCollision(SDCard{Name: "GOPRO"}, source, destDir, "GX010001.MP4", info, info.ModTime())
+	if err != nil || name != "GX010001_1.MP4" || digest == "" {
+		t.Fatalf("renamed copy: got %s, digest %q, %v", name, digest, err)
+	}
+}
+
+func TestResolveCollisionRenames(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "GX010001.MP4")
+	info := writeTestFile(t, source, "footage")
+	destDir := filepath.Join(useTestArchive(t), "GOPRO")
+	writeTestFile(t, filepath.Join(destDir, "GX010001.MP4"), "another")
+
+	name, digest, err := resolveCollision(SDCard{Name: "GOPRO"}, source, destDir, "GX010001.MP4", info, info.ModTime())
+	if err != nil || name != "GX010001_1.MP4" || digest != "" {
+		t.Fatalf("skip-identical: got %s, digest %q, %v", name, digest, err)
+	}
+
+	// The suffix strategy renames even an identical file
+	writeTestFile(t, filepath.Join(destDir, "GX010001.MP4"), "footage")
+	name, digest, err = resolveCollision(SDCard{Name: "GOPRO", CollisionStrategy: CollisionSuffix}, source, destDir, "GX010001.MP4", info, info.ModTime())
+	if err != nil || name != "GX010001_1.MP4" || digest != "" {
+		t.Fatalf("suffix: got %s, digest %q, %v", name, digest, err)
+	}
+
+	want := "GX010001_" + info.ModTime().In(currentSettings().timezone).Format("20060102-150405") + ".MP4"
+	name, _, err = resolveCollision(SDCard{Name: "GOPRO", CollisionStrategy: CollisionTimestamp}, source, destDir, "GX010001.MP4", info, info.ModTime())
+	if err != nil || name != want {
+		t.Fatalf("timestamp: got %s, %v, want %s", name, err, want)
+	}
+}
+
+func TestPlannedDestination(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "GX010001.MP4")
+	info := writeTestFile(t, source, "footage")
+	destination := filepath.Join(useTestArchive(t), "GOPRO", "GX010001_1.MP4")
+	job := &IngestJob{Files: map[string]*FileProgress{
+		source: {Source: source, Destination: destination, Size: info.Size()},
+	}}
+
+	if planned := plannedDestination(job, source, info); planned != destination {
+		t.Fatalf("nothing stored yet: got %q", planned)
+	}
+	// The crash may have happened after the copy was stored but before it was recorded
+	writeTestFile(t, destination, "footage")
+	if planned := plannedDestination(job, source, info); planned != destination {
+		t.Fatalf("unrecorded copy: got %q", planned)
+	}
+	writeTestFile(t, destination, "other footage")
+	if planned := plannedDestination(job, source, info); planned != "" {
+		t.Fatalf("name taken by another file: got %q", planned)
+	}
+	if planned := plannedDestination(job, filepath.Join(filepath.Dir(source), "GX010002.MP4"), info); planned != "" {
+		t.Fatalf("unrecorded source: got %q", planned)
+	}
+}
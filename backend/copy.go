@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// manifestFileName is the sidecar file in each destination folder holding the digests of imported files.
+// It uses the sha256sum format so an archive can be audited with `sha256sum -c manifest.sha256`.
+const manifestFileName = "manifest.sha256"
+
+// partialSuffix is appended to files while they are being copied, so an interrupted copy is never mistaken for a complete file.
+const partialSuffix = ".partial"
+
+var manifestLock sync.Mutex // Serializes manifest updates from concurrent ingests
+
+// writeFileVerified writes src to dst, hashing the data as it is written, fsyncs it,
+// then re-reads the destination bypassing the page cache and compares size and digest with what was read.
+// The re-read comes from the disk or, for NFS, from the server, so it catches data corrupted on the way there.
+// Filesystems without O_DIRECT, such as tmpfs, are re-read through the cache, which only proves that
+// the kernel accepted the data. The file only appears under its final name once the digests match.
+// It returns the hex encoded SHA-256 digest and the size of the file.
+func writeFileVerified(dst string, src io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil { // Explicitly set permissions to 0777
+		return "", 0, fmt.Errorf("failed to create directory for %s: %v", dst, err)
+	}
+
+	tmpPath := dst + partialSuffix
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create %s: %v", tmpPath, err)
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hasher), src)
+	if err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return "", 0, fmt.Errorf("failed to copy to %s: %v", tmpPath, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmpPath)
+		return "", 0, fmt.Errorf("failed to sync %s: %v", tmpPath, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", 0, fmt.Errorf("failed to close %s: %v", tmpPath, err)
+	}
+	sourceDigest := hex.EncodeToString(hasher.Sum(nil))
+
+	// Re-read the destination to make sure what landed on disk matches what was read
+	destDigest, destSize, err := hashFileUncached(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", 0, err
+	}
+	if destSize != size || destDigest != sourceDigest {
+		os.Remove(tmpPath)
+		return "", 0, fmt.Errorf("verification failed for %s: source %s (%d bytes), destination %s (%d bytes)", dst, sourceDigest, size, destDigest, destSize)
+	}
+
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return "", 0, fmt.Errorf("failed to rename %s to %s: %v", tmpPath, dst, err)
+	}
+	syncDir(filepath.Dir(dst))
+
+	return sourceDigest, size, nil
+}
+
+// contextReader fails reads once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// hashFile returns the hex encoded SHA-256 digest and the size of the file at path.
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// directIOAlign is the buffer alignment O_DIRECT reads need, a multiple of the logical block size of any disk.
+const directIOAlign = 4096
+
+// hashFileUncached returns the hex encoded SHA-256 digest and the size of the file at path, read with O_DIRECT
+// so the data comes from the storage rather than the page cache. It falls back to a cached read where
+// the filesystem does not support O_DIRECT.
+func hashFileUncached(path string) (string, int64, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if errors.Is(err, syscall.EINVAL) {
+		return hashFile(path)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	// O_DIRECT needs a buffer aligned in memory, whole blocks are read until the short read at the end
+	raw := make([]byte, 1<<20+directIOAlign)
+	offset := directIOAlign - int(uintptr(unsafe.Pointer(&raw[0]))%directIOAlign)
+	buf := raw[offset%directIOAlign:][:1<<20]
+
+	hasher := sha256.New()
+	var size int64
+	for {
+		n, err := file.Read(buf)
+		hasher.Write(buf[:n])
+		size += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) && size == 0 {
+			return hashFile(path) // Some filesystems accept the flag but not the reads
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// syncDir fsyncs a directory so a rename inside it is durable. Errors are ignored
+// because some network filesystems do not support syncing directories.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// readManifest reads the manifest of dir, which is stored next to the originals, and returns a map of file name to digest.
+func readManifest(dir string) (map[string]string, error) {
+	entries := make(map[string]string)
+	settings := currentSettings()
+	key, err := settings.archiveKey(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := settings.originals.OpenRange(key, 0, -1)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest in %s: %v", dir, err)
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		digest, name, found := strings.Cut(scanner.Text(), "  ")
+		if found {
+			entries[name] = digest
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest in %s: %v", dir, err)
+	}
+	return entries, nil
+}
+
+// recordManifest adds or replaces the digest of name in the manifest of dir.
+func recordManifest(dir, name, digest string) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	entries, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	entries[name] = digest
+	return writeManifest(dir, entries)
+}
+
+// moveManifestEntry moves the digest of name from the manifest of srcDir to the manifest of dstDir.
+// Nothing happens when the file was never recorded in a manifest.
+func moveManifestEntry(srcDir, dstDir, name string) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	source, err := readManifest(srcDir)
+	if err != nil {
+		return err
+	}
+	digest, exists := source[name]
+	if !exists {
+		return nil
+	}
+
+	destination, err := readManifest(dstDir)
+	if err != nil {
+		return err
+	}
+	destination[name] = digest
+	if err := writeManifest(dstDir, destination); err != nil {
+		return err
+	}
+
+	delete(source, name)
+	return writeManifest(srcDir, source)
+}
+
+// writeManifest replaces the manifest of dir in the storage of the originals. The caller must hold manifestLock.
+func writeManifest(dir string, entries map[string]string) error {
+	names := make([]string, 0, len(entries))
+	for entryName := range entries {
+		names = append(names, entryName)
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	for _, entryName := range names {
+		fmt.Fprintf(&builder, "%s  %s\n", entries[entryName], entryName)
+	}
+
+	settings := currentSettings()
+	key, err := settings.archiveKey(filepath.Join(dir, manifestFileName))
+	if err != nil {
+		return err
+	}
+	content := builder.String()
+	if _, err := settings.originals.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+		return fmt.Errorf("failed to write manifest in %s: %v", dir, err)
+	}
+	return nil
+}
+
+// isArchiveMetadata reports whether a file in a destination folder is bookkeeping rather than footage.
+func isArchiveMetadata(fileName string) bool {
+	return fileName == manifestFileName || strings.HasSuffix(fileName, partialSuffix)
+}
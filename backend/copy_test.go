@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileVerified(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "GOPRO", "copy.MP4")
+	data := make([]byte, 1<<20)
+
+	digest, size, err := writeFileVerified(dst, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, _ := hashFile(dst)
+	if digest != want || size != 1<<20 {
+		t.Fatalf("got %s (%d bytes), want %s (%d bytes)", digest, size, want, 1<<20)
+	}
+	if _, err := os.Stat(dst + partialSuffix); !os.IsNotExist(err) {
+		t.Fatal("partial file was left behind")
+	}
+}
+
+func TestStoreOriginalStopsWhenAborted(t *testing.T) {
+	root := useTestArchive(t)
+	src := filepath.Join(t.TempDir(), "DJI_0001.MP4")
+	dst := filepath.Join(root, "OSMO", "DJI_0001.MP4")
+	if err := os.WriteFile(src, make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Abort once the copy is under way
+	ctx, cancel := context.WithCancelCause(context.Background())
+	progress := func(written int64) { cancel(errIngestAborted) }
+	if _, err := storeOriginal(ctx, src, dst, 1<<20, progress); !errors.Is(err, errIngestAborted) {
+		t.Fatalf("got %v, want %v", err, errIngestAborted)
+	}
+	for _, path := range []string{dst, dst + partialSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s exists after an aborted copy", path)
+		}
+	}
+}
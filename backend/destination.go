@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Destination types for DestinationConfig.Type.
+const (
+	DestinationLocal = "local" // The archive root is a folder on a local disk
+	DestinationNFS   = "nfs"   // The archive root is on an NFS share, mounted by the processor when a server is configured
+)
+
+const (
+	destinationCheckInterval = 30 * time.Second
+	destinationMountTimeout  = 30 * time.Second
+)
+
+// destinationStatTimeout bounds every filesystem call on the destination, since a hard mount
+// of an unreachable server blocks them forever.
+var destinationStatTimeout = 10 * time.Second
+
+// DestinationHealth is the last known state of the archive destination.
+type DestinationHealth struct {
+	Type       string    `json:"type"`
+	Path       string    `json:"path"`
+	MountPoint string    `json:"mountPoint,omitempty"`
+	Healthy    bool      `json:"healthy"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checkedAt"`
+}
+
+// destinationCheckMu serializes checks and mounts of the destination.
+var destinationCheckMu sync.Mutex
+
+// destinationHealthMu guards destinationHealth, so the last known health is served without waiting for a running check.
+var destinationHealthMu sync.Mutex
+var destinationHealth DestinationHealth
+
+// blockedCalls holds the paths with a filesystem call that timed out and has not returned yet.
+var blockedCalls = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// callWithTimeout runs fn, a filesystem call on path, giving up after destinationStatTimeout. A call that hangs keeps
+// running in the background, and until it returns further calls on the same path fail right away instead of
+// leaving another goroutine blocked on the share.
+func callWithTimeout(path string, fn func() error) error {
+	blockedCalls.Lock()
+	if blockedCalls.paths[path] {
+		blockedCalls.Unlock()
+		return fmt.Errorf("%s is not responding, an earlier call is still waiting", path)
+	}
+	blockedCalls.paths[path] = true
+	blockedCalls.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := fn()
+		blockedCalls.Lock()
+		delete(blockedCalls.paths, path)
+		blockedCalls.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(destinationStatTimeout):
+		return fmt.Errorf("%s is not responding", path)
+	}
+}
+
+// runWithTimeout runs a mount command, killing it when it does not finish within destinationMountTimeout.
+func runWithTimeout(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), destinationMountTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if ctx.Err() != nil {
+		return output, fmt.Errorf("%s timed out after %v", name, destinationMountTimeout)
+	}
+	return output, err
+}
+
+// mountPoint returns where the NFS share is mounted, which defaults to the archive root.
+func (c DestinationConfig) mountPoint(archiveRoot string) string {
+	if c.MountPoint == "" {
+		return archiveRoot
+	}
+	return c.MountPoint
+}
+
+// validateDestination checks the destination type and the NFS settings.
+func validateDestination(c DestinationConfig) error {
+	switch c.Type {
+	case DestinationLocal:
+		return nil
+	case DestinationNFS:
+	default:
+		return fmt.Errorf("invalid destination type: %s", c.Type)
+	}
+	if (c.Server == "") != (c.Export == "") {
+		return fmt.Errorf("nfs destination needs both server and export, or neither to use an existing mount")
+	}
+	if c.MountPoint != "" && !filepath.IsAbs(c.MountPoint) {
+		return fmt.Errorf("mount point must be an absolute path: %s", c.MountPoint)
+	}
+	if c.MountPoint != "" && c.Path != "" && !strings.HasPrefix(filepath.Clean(c.Path)+"/", filepath.Clean(c.MountPoint)+"/") {
+		return fmt.Errorf("destination path %s is not inside the mount point %s", c.Path, c.MountPoint)
+	}
+	return nil
+}
+
+// nfsSuperMagic is the filesystem type statfs reports for NFS, also through the bind mount of an LXC container.
+const nfsSuperMagic = 0x6969
+
+// onNFS reports whether path is on an NFS filesystem, giving up when the filesystem does not answer.
+func onNFS(path string) (bool, error) {
+	var fsType int64
+	err := callWithTimeout(path, func() error {
+		var stat syscall.Statfs_t
+		err := syscall.Statfs(path, &stat)
+		fsType = int64(stat.Type) // Only read once the call returned
+		return err
+	})
+	return err == nil && fsType == nfsSuperMagic, err
+}
+
+// mkdirWithTimeout creates a folder on the destination, giving up when the filesystem does not answer.
+func mkdirWithTimeout(path string) error {
+	return callWithTimeout(path, func() error {
+		return os.MkdirAll(path, 0777) // Explicitly set permissions to 0777
+	})
+}
+
+// mountNFS mounts the configured share at mountPoint.
+func mountNFS(c DestinationConfig, mountPoint string) error {
+	if err := mkdirWithTimeout(mountPoint); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %v", mountPoint, err)
+	}
+	args := []string{"-t", "nfs"}
+	if c.Options != "" {
+		args = append(args, "-o", c.Options)
+	}
+	args = append(args, c.Server+":"+c.Export, mountPoint)
+	output, err := runWithTimeout("mount", args...)
+	if err != nil {
+		return fmt.Errorf("failed to mount %s:%s to %s: %v\nOutput: %s", c.Server, c.Export, mountPoint, err, output)
+	}
+	logReceiver.Info("Mounted NFS share %s:%s at %s", c.Server, c.Export, mountPoint)
+	return nil
+}
+
+// checkNFS verifies the share, remounting it when the handle went stale and mounting it when it is missing.
+// Without a configured server the share is mounted outside the processor and only verified.
+func checkNFS(c DestinationConfig, archiveRoot string) error {
+	mountPoint := c.mountPoint(archiveRoot)
+	mounted, err := onNFS(mountPoint)
+	if err != nil && !os.IsNotExist(err) { // Usually syscall.ESTALE after the server restarted or the export changed
+		if errors.Is(err, syscall.ESTALE) {
+			err = fmt.Errorf("stale file handle")
+		}
+		if c.Server == "" {
+			return fmt.Errorf("NFS share at %s is unusable: %v", mountPoint, err)
+		}
+		logReceiver.Warn("NFS share at %s is unusable, remounting it: %v", mountPoint, err)
+		if output, err := runWithTimeout("umount", "-f", "-l", mountPoint); err != nil {
+			logReceiver.WithField("output", string(output)).Warn("Error unmounting %s: %v", mountPoint, err)
+		}
+		mounted = false
+	}
+
+	if !mounted {
+		if c.Server == "" {
+			return fmt.Errorf("no NFS share is mounted at %s", mountPoint)
+		}
+		if err := mountNFS(c, mountPoint); err != nil {
+			return err
+		}
+		if mounted, _ := onNFS(mountPoint); !mounted {
+			return fmt.Errorf("NFS share is not mounted at %s after mounting", mountPoint)
+		}
+	}
+
+	// Only create the archive root once the share is known to be mounted, never on the local disk below it
+	if err := mkdirWithTimeout(archiveRoot); err != nil {
+		return fmt.Errorf("failed to create archive root %s on the NFS share: %v", archiveRoot, err)
+	}
+	return nil
+}
+
+// checkLocal verifies the local archive root, creating it if needed.
+func checkLocal(archiveRoot string) error {
+	if err := mkdirWithTimeout(archiveRoot); err != nil {
+		return fmt.Errorf("failed to create archive root %s: %v", archiveRoot, err)
+	}
+	return nil
+}
+
+// ensureDestination checks that the archive destination is usable, repairing the NFS mount if it can,
+// and records and publishes its health. It returns why the destination cannot be written to.
+// Every filesystem call and mount is bounded by a timeout, so a check never blocks for long.
+func ensureDestination() error {
+	destinationCheckMu.Lock()
+	defer destinationCheckMu.Unlock()
+
+	settings := currentSettings()
+	config, archiveRoot := settings.destinationConfig, settings.paths.ArchiveRoot
+	health := DestinationHealth{Type: config.Type, Path: archiveRoot, CheckedAt: time.Now()}
+	var err error
+	if config.Type == DestinationNFS {
+		health.MountPoint = config.mountPoint(archiveRoot)
+		err = checkNFS(config, archiveRoot)
+	} else {
+		err = checkLocal(archiveRoot)
+	}
+	health.Healthy = err == nil
+	if err != nil {
+		health.Error = err.Error()
+	}
+
+	destinationHealthMu.Lock()
+	previous := destinationHealth
+	destinationHealth = health
+	destinationHealthMu.Unlock()
+
+	if health.Healthy != previous.Healthy || health.Error != previous.Error {
+		if health.Healthy {
+			logReceiver.Info("Destination %s is available", health.Path)
+		} else {
+			logReceiver.Error("Destination %s is unavailable: %v", health.Path, err)
+		}
+		publishDestinationHealth(health)
+	}
+	return err
+}
+
+// publishDestinationHealth pushes the destination health as JSON to WebSocket clients.
+func publishDestinationHealth(health DestinationHealth) {
+	data, err := json.Marshal(struct {
+		Type        string            `json:"type"` // Always "destination"
+		Destination DestinationHealth `json:"destination"`
+	}{"destination", health})
+	if err != nil {
+		return
+	}
+	logReceiver.publish(data)
+}
+
+// monitorDestination checks the destination periodically so a stale or missing share is noticed between imports.
+func monitorDestination() {
+	for {
+		ensureDestination()
+		time.Sleep(destinationCheckInterval)
+	}
+}
+
+// HandleDestinationHealth handles GET /api/destination with the last known destination health.
+func HandleDestinationHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	destinationHealthMu.Lock()
+	health := destinationHealth
+	destinationHealthMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallWithTimeoutDoesNotStackBlockedCalls(t *testing.T) {
+	saved := destinationStatTimeout
+	destinationStatTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { destinationStatTimeout = saved })
+
+	release := make(chan struct{})
+	var calls atomic.Int32
+	hang := func() error {
+		calls.Add(1)
+		<-release
+		return nil
+	}
+	if err := callWithTimeout("/mnt/share", hang); err == nil || !strings.Contains(err.Error(), "not responding") {
+		t.Fatalf("hanging call: %v", err)
+	}
+	// While the first call is stuck, no new call is started on the same path
+	if err := callWithTimeout("/mnt/share", hang); err == nil {
+		t.Fatal("second call succeeded while the first was blocked")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("started %d calls, want 1", n)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for callWithTimeout("/mnt/share", func() error { return nil }) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("path still blocked after the call returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceState is where a card is in the ingest workflow.
+type DeviceState string
+
+const (
+	StateDetected    DeviceState = "detected"
+	StateMounting    DeviceState = "mounting"
+	StateCopying     DeviceState = "copying"
+	StateVerifying   DeviceState = "verifying"
+	StateTranscoding DeviceState = "transcoding"
+	StateClearing    DeviceState = "clearing"
+	StateEjecting    DeviceState = "ejecting"
+	StateDone        DeviceState = "done"
+	StateFailed      DeviceState = "failed"
+	StateRemoved     DeviceState = "removed"
+)
+
+// stageStates maps the ingest job stages to the device state shown while the stage runs.
+var stageStates = map[JobStage]DeviceState{
+	StageMount:   StateMounting,
+	StageCopy:    StateCopying,
+	StageVerify:  StateVerifying,
+	StageCatalog: StateVerifying,
+	StageProxy:   StateTranscoding,
+	StageClear:   StateClearing,
+	StageEject:   StateEjecting,
+}
+
+// Device is the status of a card that was connected since the processor started.
+type Device struct {
+	Type      string      `json:"type"`  // Always "device"
+	Label     string      `json:"label"` // Key of the SD card mapping that recognized the card
+	Block     BlockDevice `json:"block"`
+	State     DeviceState `json:"state"`
+	JobID     string      `json:"jobId,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Connected bool        `json:"connected"`
+	Running   bool        `json:"running"` // An ingest goroutine is working on the card
+	UpdatedAt time.Time   `json:"updatedAt"`
+
+	ctx      context.Context         // Cancelled with errIngestAborted to ask the running ingest to stop
+	abort    context.CancelCauseFunc // Cancels ctx
+	finished chan struct{}           // Closed when the running ingest has stopped
+}
+
+// errIngestAborted is returned by an ingest that stopped because it was aborted from the API.
+var errIngestAborted = errors.New("ingest aborted")
+
+// startLocked marks a device as being processed by a new ingest. The caller must hold r.mu.
+func (r *DeviceRegistry) startLocked(device *Device) {
+	device.Running = true
+	device.ctx, device.abort = context.WithCancelCause(context.Background())
+	device.finished = make(chan struct{})
+	r.setLocked(device, StateDetected, "")
+}
+
+// UnknownDevice is a connected card that no SD card mapping recognizes. It waits to be claimed from the UI.
+type UnknownDevice struct {
+	Block      BlockDevice `json:"block"`
+	SourceDirs []string    `json:"sourceDirs"` // Detected folders that hold footage, relative to the card root
+	DetectedAt time.Time   `json:"detectedAt"`
+}
+
+// DeviceRegistry tracks the state of every card. It is safe for concurrent use by the device loop,
+// the ingest goroutines and the HTTP handlers, and pushes every transition to the WebSocket clients.
+type DeviceRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*Device
+	unknown map[string]*UnknownDevice // Keyed by filesystem UUID
+}
+
+var devices = NewDeviceRegistry()
+
+// NewDeviceRegistry creates an empty registry.
+func NewDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{
+		devices: make(map[string]*Device),
+		unknown: make(map[string]*UnknownDevice),
+	}
+}
+
+// Claim marks an inserted card as detected and reports whether the caller should start an ingest for it.
+// A card that is already being processed, or that finished or failed since it was inserted, is not claimed again;
+// failed cards are retried through Retry.
+func (r *DeviceRegistry) Claim(label string, block BlockDevice) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.devices[label]
+	if exists && device.Running {
+		// Reinserted while the ingest that lost the card is still winding down, Finish makes it retryable
+		device.Connected = true
+		device.Block = block
+		return false
+	}
+	if exists && device.Connected {
+		return false
+	}
+	r.devices[label] = &Device{Label: label, Block: block, Connected: true}
+	r.startLocked(r.devices[label])
+	return true
+}
+
+// Retry claims a connected card whose ingest failed or finished so it runs again.
+func (r *DeviceRegistry) Retry(label string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.devices[label]
+	switch {
+	case !exists || !device.Connected:
+		return fmt.Errorf("device %s is not connected", label)
+	case device.Running:
+		return fmt.Errorf("device %s is still being processed", label)
+	case device.State != StateFailed && device.State != StateDone:
+		return fmt.Errorf("device %s is %s", label, device.State)
+	}
+	r.startLocked(device)
+	return nil
+}
+
+// Abort asks the running ingest of a connected card to stop at the next file or stage.
+// The returned channel is closed once no ingest is running for the card.
+func (r *DeviceRegistry) Abort(label string) (<-chan struct{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.devices[label]
+	if !exists || !device.Connected {
+		return nil, fmt.Errorf("device %s is not connected", label)
+	}
+	if !device.Running {
+		stopped := make(chan struct{})
+		close(stopped)
+		return stopped, nil
+	}
+	device.abort(errIngestAborted)
+	return device.finished, nil
+}
+
+// Aborted reports whether the running ingest of a card was asked to stop.
+func (r *DeviceRegistry) Aborted(label string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.devices[label]
+	return exists && device.ctx != nil && device.ctx.Err() != nil
+}
+
+// Context returns a context that is cancelled with errIngestAborted when the running ingest of a card is aborted.
+func (r *DeviceRegistry) Context(label string) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if device, exists := r.devices[label]; exists && device.ctx != nil {
+		return device.ctx
+	}
+	return context.Background()
+}
+
+// Set moves a card that is not being processed to a state, e.g. after an eject from the API.
+func (r *DeviceRegistry) Set(label string, state DeviceState, errorMessage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if device, exists := r.devices[label]; exists && !device.Running && device.State != StateRemoved {
+		r.setLocked(device, state, errorMessage)
+	}
+}
+
+// Transition moves a card to a new state. Transitions of removed cards are ignored.
+func (r *DeviceRegistry) Transition(label string, state DeviceState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if device, exists := r.devices[label]; exists && device.State != StateRemoved {
+		r.setLocked(device, state, "")
+	}
+}
+
+// SetJob records the ingest job that is processing the card.
+func (r *DeviceRegistry) SetJob(label, jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if device, exists := r.devices[label]; exists {
+		device.JobID = jobID
+		r.publishLocked(device)
+	}
+}
+
+// Finish records the outcome of an ingest: done, or failed with the error.
+func (r *DeviceRegistry) Finish(label string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.devices[label]
+	if !exists {
+		return
+	}
+	if device.Running {
+		close(device.finished)
+	}
+	device.Running = false
+	switch {
+	case device.State == StateRemoved && device.Connected:
+		r.setLocked(device, StateFailed, "card was removed during ingest")
+	case device.State == StateRemoved:
+		r.publishLocked(device)
+	case err != nil:
+		r.setLocked(device, StateFailed, err.Error())
+	default:
+		r.setLocked(device, StateDone, "")
+	}
+}
+
+// Removed records that the filesystem with the given UUID was pulled out.
+// It returns the label of the card, or false if the device was not a known card.
+func (r *DeviceRegistry) Removed(uuid string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.unknown[uuid]; exists {
+		delete(r.unknown, uuid)
+		r.publishUnknownLocked()
+		return "", false
+	}
+	for _, device := range r.devices {
+		if device.Connected && device.Block.UUID == uuid {
+			device.Connected = false
+			r.setLocked(device, StateRemoved, device.Error)
+			return device.Label, true
+		}
+	}
+	return "", false
+}
+
+// AddUnknown records a connected card that no mapping recognizes.
+func (r *DeviceRegistry) AddUnknown(device UnknownDevice) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unknown[device.Block.UUID] = &device
+	r.publishUnknownLocked()
+}
+
+// TakeUnknown removes an unknown card from the registry so it can be claimed.
+func (r *DeviceRegistry) TakeUnknown(uuid string) (UnknownDevice, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.unknown[uuid]
+	if !exists {
+		return UnknownDevice{}, false
+	}
+	delete(r.unknown, uuid)
+	r.publishUnknownLocked()
+	return *device, true
+}
+
+// Unknown returns the unclaimed cards, oldest first.
+func (r *DeviceRegistry) Unknown() []UnknownDevice {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.unknownLocked()
+}
+
+// unknownLocked returns the unclaimed cards, oldest first. The caller must hold r.mu.
+func (r *DeviceRegistry) unknownLocked() []UnknownDevice {
+	all := make([]UnknownDevice, 0, len(r.unknown))
+	for _, device := range r.unknown {
+		all = append(all, *device)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].DetectedAt.Before(all[j].DetectedAt) })
+	return all
+}
+
+// publishUnknownLocked pushes the list of unclaimed cards to the WebSocket clients. The caller must hold r.mu.
+func (r *DeviceRegistry) publishUnknownLocked() {
+	data, err := json.Marshal(struct {
+		Type    string          `json:"type"` // Always "unknown-devices"
+		Devices []UnknownDevice `json:"devices"`
+	}{"unknown-devices", r.unknownLocked()})
+	if err != nil {
+		return
+	}
+	logReceiver.publish(data)
+}
+
+// Get returns the status of a card.
+func (r *DeviceRegistry) Get(label string) (Device, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	device, exists := r.devices[label]
+	if !exists {
+		return Device{}, false
+	}
+	return *device, true
+}
+
+// All returns the status of every card, sorted by label.
+func (r *DeviceRegistry) All() []Device {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]Device, 0, len(r.devices))
+	for _, device := range r.devices {
+		all = append(all, *device)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Label < all[j].Label })
+	return all
+}
+
+// setLocked changes the state of a device and publishes it. The caller must hold r.mu.
+func (r *DeviceRegistry) setLocked(device *Device, state DeviceState, errorMessage string) {
+	device.State = state
+	device.Error = errorMessage
+	device.UpdatedAt = time.Now()
+	r.publishLocked(device)
+}
+
+// publishLocked pushes the status of a device to the WebSocket clients. The caller must hold r.mu.
+func (r *DeviceRegistry) publishLocked(device *Device) {
+	logReceiver.DeviceUpdate(*device)
+}
+
+// HandleDevices handles GET /api/devices, listing the state of every card seen since startup.
+func HandleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices.All())
+}
+
+// HandleDeviceAction handles POST /api/devices/{label}/retry, which runs the ingest of a connected card again,
+// POST /api/devices/{label}/abandon, which gives up the open job of a card so its next ingest starts a new job,
+// and POST /api/devices/{label}/eject, which aborts a running ingest and unmounts the card.
+func HandleDeviceAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	label, action, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+	if !found || label == "" {
+		http.Error(w, "Expected /api/devices/{label}/{action}", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "retry":
+		if err := devices.Retry(label); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logReceiver.WithDevice(label).Info("Retrying ingest of %s", label)
+		go ingestDevice(label)
+	case "abandon":
+		if device, exists := devices.Get(label); exists && device.Running {
+			http.Error(w, fmt.Sprintf("device %s is still being processed", label), http.StatusConflict)
+			return
+		}
+		job, err := jobStore.Abandon(label)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		logReceiver.WithJob(job).Info("Abandoned ingest job %s for %s, the next ingest starts a new job", job.ID, label)
+	case "eject":
+		if _, exists := currentSettings().sdCardMappings[label]; !exists {
+			http.Error(w, fmt.Sprintf("No configuration found for label: %s", label), http.StatusNotFound)
+			return
+		}
+		stopped, err := devices.Abort(label)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logReceiver.WithDevice(label).Info("Ejecting %s", label)
+		go func() {
+			<-stopped
+			ejectDevice(label)
+		}()
+	default:
+		http.Error(w, fmt.Sprintf("Unknown device action: %s", action), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ejectDevice unmounts a card that is not being processed. The card keeps the outcome of its last ingest,
+// so a failed or aborted card can still be retried while it is in the reader.
+func ejectDevice(label string) {
+	device, exists := devices.Get(label)
+	sdCard, mapped := currentSettings().sdCardMappings[label]
+	if !exists || !mapped {
+		return
+	}
+
+	devices.Set(label, StateEjecting, "")
+	if err := ejectSDCard(sdCard); err != nil {
+		logReceiver.WithDevice(label).Error("Error ejecting %s: %v", label, err)
+		devices.Set(label, StateFailed, err.Error())
+		return
+	}
+	devices.Set(label, device.State, device.Error)
+}
+
+// HandleUnknownDevices handles GET /api/devices/unknown, listing connected cards that no mapping recognizes.
+func HandleUnknownDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices.Unknown())
+}
+
+// ClaimUnknownDevice handles POST /api/devices/unknown/{uuid}/claim with {"name", "profile", "sourceDirs", "destination"}.
+// It saves a new SD card mapping that recognizes the card by its UUID and starts the ingest.
+func ClaimUnknownDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	uuid, action, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/devices/unknown/"), "/")
+	if !found || uuid == "" || action != "claim" {
+		http.Error(w, "Expected /api/devices/unknown/{uuid}/claim", http.StatusNotFound)
+		return
+	}
+
+	var request struct {
+		Name        string   `json:"name"`
+		Profile     string   `json:"profile"`
+		SourceDirs  []string `json:"sourceDirs"`
+		Destination string   `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Name == "" || strings.ContainsAny(request.Name, `/\`) || strings.HasPrefix(request.Name, ".") {
+		http.Error(w, "Invalid card name", http.StatusBadRequest)
+		return
+	}
+	if (len(request.SourceDirs) == 0 && request.Profile == "") || request.Destination == "" {
+		http.Error(w, "Source directories or a camera profile and a destination are required", http.StatusBadRequest)
+		return
+	}
+
+	unknown, exists := devices.TakeUnknown(uuid)
+	if !exists {
+		http.Error(w, fmt.Sprintf("Unknown device %s is not connected", uuid), http.StatusNotFound)
+		return
+	}
+
+	err := updateConfig(func(config *Config) error {
+		if _, exists := config.SDCardMappings[request.Name]; exists {
+			return fmt.Errorf("an SD card named %s already exists", request.Name)
+		}
+		if config.SDCardMappings == nil {
+			config.SDCardMappings = make(map[string]SDCard)
+		}
+		config.SDCardMappings[request.Name] = SDCard{
+			Name:        request.Name,
+			Profile:     request.Profile,
+			SourceDirs:  request.SourceDirs,
+			Destination: request.Destination,
+			Match:       &CardMatch{UUID: uuid},
+		}
+		return nil
+	})
+	if err != nil {
+		devices.AddUnknown(unknown) // Leave the card claimable
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logReceiver.WithDevice(request.Name).Info("Claimed device %s as new SD card %s", unknown.Block.Node, request.Name)
+	if devices.Claim(request.Name, unknown.Block) {
+		go ingestDevice(request.Name)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// detectSourceDirs lists the folders of a card that hold footage: every DCIM subfolder and the source folders
+// of the camera profiles that contain files, relative to the card root.
+func detectSourceDirs(content *cardContent) []string {
+	root, err := content.root()
+	if err != nil {
+		return nil
+	}
+
+	var candidates []string
+	if entries, err := os.ReadDir(filepath.Join(root, "DCIM")); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				candidates = append(candidates, filepath.Join("DCIM", entry.Name()))
+			}
+		}
+	}
+	for _, dir := range cameraSourceDirs() {
+		if !strings.HasPrefix(dir, "DCIM/") {
+			candidates = append(candidates, dir)
+		}
+	}
+
+	var dirs []string
+	for _, dir := range candidates {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !shouldIgnoreFile(entry.Name()) {
+				dirs = append(dirs, dir)
+				break
+			}
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// deviceLoopHarness runs the device loop on a fake watcher with fake block devices.
+type deviceLoopHarness struct {
+	t       *testing.T
+	watcher *FakeDeviceWatcher
+
+	mu        sync.Mutex
+	blocks    map[string]BlockDevice
+	gates     map[string]chan struct{} // Probes of these devices wait until the channel is closed
+	probes    int
+	processed []string
+}
+
+func newDeviceLoopHarness(t *testing.T) *deviceLoopHarness {
+	t.Helper()
+	useTestSettings(t, func(settings *Settings) {
+		settings.sdCardMappings = map[string]SDCard{"GOPRO": {Name: "GOPRO"}, "DJI": {Name: "DJI"}}
+	})
+	previousDevices, previousProbe := devices, probeDevice
+	devices = NewDeviceRegistry()
+
+	h := &deviceLoopHarness{
+		t:       t,
+		watcher: NewFakeDeviceWatcher(),
+		blocks: map[string]BlockDevice{
+			"card-1": {UUID: "card-1", Node: "/dev/test-card-1", Label: "GOPRO"},
+			"card-2": {UUID: "card-2", Node: "/dev/test-card-2", Label: "DJI"},
+			"other":  {UUID: "other", Node: "/dev/test-other", Label: "NO NAME"},
+		},
+		gates: make(map[string]chan struct{}),
+	}
+	probeDevice = h.probe
+
+	events, err := h.watcher.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		runDeviceLoop(events, h.process)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		h.mu.Lock()
+		for _, gate := range h.gates {
+			close(gate)
+		}
+		h.gates = nil
+		h.mu.Unlock()
+		h.watcher.Stop()
+		<-done
+		devices, probeDevice = previousDevices, previousProbe
+	})
+	return h
+}
+
+// probe stands in for probeBlockDevice. It blocks while the device has a gate.
+func (h *deviceLoopHarness) probe(uuid string) (BlockDevice, error) {
+	h.mu.Lock()
+	gate := h.gates[uuid]
+	h.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probes++
+	return h.blocks[uuid], nil
+}
+
+// hold makes the probes of a device wait until release is called.
+func (h *deviceLoopHarness) hold(uuid string) {
+	h.mu.Lock()
+	h.gates[uuid] = make(chan struct{})
+	h.mu.Unlock()
+}
+
+func (h *deviceLoopHarness) release(uuid string) {
+	h.mu.Lock()
+	close(h.gates[uuid])
+	delete(h.gates, uuid)
+	h.mu.Unlock()
+}
+
+// process stands in for the ingest. It finishes right away and then records the label, so a test that saw the
+// label no longer races with the ingest goroutine.
+func (h *deviceLoopHarness) process(label string) {
+	devices.Finish(label, nil)
+	h.mu.Lock()
+	h.processed = append(h.processed, label)
+	h.mu.Unlock()
+}
+
+func (h *deviceLoopHarness) processedLabels() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.processed...)
+}
+
+func (h *deviceLoopHarness) probeCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.probes
+}
+
+// waitFor polls cond until it holds or fails the test after a second.
+func (h *deviceLoopHarness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// count returns how often label was processed.
+func (h *deviceLoopHarness) count(label string) int {
+	count := 0
+	for _, processed := range h.processedLabels() {
+		if processed == label {
+			count++
+		}
+	}
+	return count
+}
+
+func (h *deviceLoopHarness) device(label string) Device {
+	device, _ := devices.Get(label)
+	return device
+}
+
+func TestDeviceLoopProcessesMappedCards(t *testing.T) {
+	h := newDeviceLoopHarness(t)
+
+	h.watcher.Insert("other")
+	h.watcher.Insert("card-1")
+	h.waitFor("ingest", func() bool { return h.count("GOPRO") == 1 })
+	h.waitFor("probes", func() bool { return h.probeCount() == 2 })
+	if labels := h.processedLabels(); len(labels) != 1 {
+		t.Fatalf("processed %v, want only GOPRO", labels)
+	}
+	if device := h.device("GOPRO"); !device.Connected || device.Block.UUID != "card-1" {
+		t.Fatalf("inserted card: %+v", device)
+	}
+}
+
+func TestDeviceLoopReinsert(t *testing.T) {
+	h := newDeviceLoopHarness(t)
+
+	h.watcher.Insert("card-1")
+	h.waitFor("first ingest", func() bool { return h.count("GOPRO") == 1 })
+	h.watcher.Remove("card-1")
+	h.waitFor("removed state", func() bool { return h.device("GOPRO").State == StateRemoved })
+	h.watcher.Insert("card-1")
+	h.waitFor("second ingest", func() bool { return h.count("GOPRO") == 2 })
+	h.waitFor("done state", func() bool { return h.device("GOPRO").State == StateDone })
+}
+
+func TestDeviceLoopSkipsProcessedCards(t *testing.T) {
+	h := newDeviceLoopHarness(t)
+
+	// A finished card stays claimed while it is connected, so a second add does not import it again
+	h.watcher.Insert("card-1")
+	h.waitFor("ingest", func() bool { return h.count("GOPRO") == 1 })
+	h.watcher.events <- DeviceEvent{Type: DeviceAdded, ID: "card-1"} // e.g. from a watcher rescan
+	h.waitFor("second probe", func() bool { return h.probeCount() == 2 })
+	h.watcher.Insert("card-2")
+	h.waitFor("other card", func() bool { return h.count("DJI") == 1 })
+	if count := h.count("GOPRO"); count != 1 {
+		t.Fatalf("processed card was imported %d times", count)
+	}
+	if state := h.device("GOPRO").State; state != StateDone {
+		t.Fatalf("card state = %s, want %s", state, StateDone)
+	}
+}
+
+func TestDeviceLoopProbesConcurrently(t *testing.T) {
+	h := newDeviceLoopHarness(t)
+
+	// A card that is slow to probe does not hold up the next one
+	h.hold("card-1")
+	h.watcher.Insert("card-1")
+	h.watcher.Insert("card-2")
+	h.waitFor("fast card", func() bool { return h.count("DJI") == 1 })
+	if count := h.count("GOPRO"); count != 0 {
+		t.Fatalf("slow card was processed %d times before its probe finished", count)
+	}
+
+	h.release("card-1")
+	h.waitFor("slow card", func() bool { return h.count("GOPRO") == 1 })
+}
+
+func TestDeviceLoopDropsProbeOfRemovedCard(t *testing.T) {
+	h := newDeviceLoopHarness(t)
+
+	h.hold("card-1")
+	h.watcher.Insert("card-1")
+	h.watcher.Remove("card-1")
+	h.watcher.Insert("card-2")
+	h.waitFor("other card", func() bool { return h.count("DJI") == 1 })
+
+	h.release("card-1")
+	h.waitFor("probe", func() bool { return h.probeCount() == 2 })
+	h.watcher.Insert("other")
+	h.waitFor("probe of another device", func() bool { return h.probeCount() == 3 })
+	if _, exists := devices.Get("GOPRO"); exists {
+		t.Fatal("card removed while it was probed was claimed")
+	}
+}
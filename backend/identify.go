@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cardIDFile is written to the root of a card on its first import and holds the name of its mapping,
+// so the card is recognized by a CardMatch with that cardId whatever its label is.
+const cardIDFile = ".videoprocessor-id"
+
+// BlockDevice describes a filesystem found by the device watcher, as published by udev below /dev/disk.
+type BlockDevice struct {
+	UUID      string `json:"uuid"`
+	Node      string `json:"node"` // e.g. /dev/sdb1
+	Label     string `json:"label,omitempty"`
+	PartLabel string `json:"partLabel,omitempty"`
+	Serial    string `json:"serial,omitempty"` // Serial number of the USB reader or SD card
+	Removable bool   `json:"removable"`        // Attached through USB or an SD slot, or flagged removable by the kernel
+}
+
+// CardMatch declares how an SDCard mapping recognizes its card. Every field that is set must match.
+// A mapping without a match rule is recognized by a volume label equal to its key.
+type CardMatch struct {
+	UUID      string `json:"uuid,omitempty"`      // Filesystem UUID, as listed in /dev/disk/by-uuid
+	Serial    string `json:"serial,omitempty"`    // USB or MMC serial, as found in /dev/disk/by-id
+	Label     string `json:"label,omitempty"`     // Volume label
+	PartLabel string `json:"partLabel,omitempty"` // GPT partition label
+	Marker    string `json:"marker,omitempty"`    // Path relative to the card root that must exist, e.g. "DCIM/DJI_001"
+	CardID    string `json:"cardId,omitempty"`    // Content of the .videoprocessor-id file on the card
+}
+
+// validate checks that the rule has at least one criterion and a marker inside the card.
+func (m CardMatch) validate() error {
+	if m == (CardMatch{}) {
+		return fmt.Errorf("match rule has no criteria")
+	}
+	if filepath.IsAbs(m.Marker) || strings.HasPrefix(filepath.Clean(m.Marker), "..") {
+		return fmt.Errorf("marker must be relative to the card root: %s", m.Marker)
+	}
+	return nil
+}
+
+// probeDevice describes a device reported by the watcher. Tests replace it to feed fake devices to the device loop.
+var probeDevice = probeBlockDevice
+
+// probeBlockDevice collects the udev names of the device with the given filesystem UUID.
+func probeBlockDevice(uuid string) (BlockDevice, error) {
+	node, err := filepath.EvalSymlinks(filepath.Join(deviceIDDir, uuid))
+	if err != nil {
+		return BlockDevice{}, fmt.Errorf("failed to resolve device %s: %v", uuid, err)
+	}
+
+	device := BlockDevice{UUID: uuid, Node: node}
+	device.Label = udevNameFor("/dev/disk/by-label", node)
+	device.PartLabel = udevNameFor("/dev/disk/by-partlabel", node)
+	for _, name := range udevNamesFor("/dev/disk/by-id", node) {
+		if serial := serialFromDiskID(name); serial != "" {
+			device.Serial = serial
+			device.Removable = true // Only USB and MMC names carry a serial
+			break
+		}
+	}
+	if !device.Removable {
+		device.Removable = sysfsRemovable(node)
+	}
+	return device, nil
+}
+
+// sysfsRemovable reports whether the kernel flags the disk of a block device node as removable.
+// Partitions have no removable attribute of their own, so the parent disk is checked as well.
+func sysfsRemovable(node string) bool {
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", filepath.Base(node)))
+	if err != nil {
+		return false
+	}
+	for _, dir := range []string{sysPath, filepath.Dir(sysPath)} {
+		if data, err := os.ReadFile(filepath.Join(dir, "removable")); err == nil {
+			return strings.TrimSpace(string(data)) == "1"
+		}
+	}
+	return false
+}
+
+// udevNameFor returns the first name in a /dev/disk directory that links to node.
+func udevNameFor(dir, node string) string {
+	names := udevNamesFor(dir, node)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// udevNamesFor returns the names in a /dev/disk directory that link to node, with udev's \xHH escapes decoded.
+func udevNamesFor(dir, node string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+		if err == nil && target == node {
+			names = append(names, unescapeUdev(entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unescapeUdev decodes the \xHH escapes udev uses for spaces and slashes in link names.
+func unescapeUdev(name string) string {
+	var decoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		if i+3 < len(name) && name[i] == '\\' && name[i+1] == 'x' {
+			if b, err := strconv.ParseUint(name[i+2:i+4], 16, 8); err == nil {
+				decoded.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		decoded.WriteByte(name[i])
+	}
+	return decoded.String()
+}
+
+// serialFromDiskID extracts the serial from a by-id name such as
+// "usb-Generic_STORAGE_DEVICE_000000000819-0:0-part1" or "mmc-SD64G_0x1a2b3c4d-part1".
+func serialFromDiskID(name string) string {
+	var rest string
+	switch {
+	case strings.HasPrefix(name, "usb-"):
+		rest = strings.TrimPrefix(name, "usb-")
+	case strings.HasPrefix(name, "mmc-"):
+		rest = strings.TrimPrefix(name, "mmc-")
+	default:
+		return ""
+	}
+	if i := strings.LastIndex(rest, "-part"); i >= 0 {
+		rest = rest[:i]
+	}
+	if i := strings.LastIndex(rest, "-"); i >= 0 && strings.Contains(rest[i:], ":") {
+		rest = rest[:i] // USB LUN, e.g. "-0:0"
+	}
+	if i := strings.LastIndex(rest, "_"); i >= 0 {
+		return rest[i+1:]
+	}
+	return ""
+}
+
+// cardContent gives access to the files on a card, mounting it read-only on first use. Internal disks are never mounted.
+type cardContent struct {
+	device     BlockDevice
+	mountPoint string
+	mounted    bool
+	err        error
+}
+
+// root returns the directory the card is mounted at.
+func (c *cardContent) root() (string, error) {
+	if c.mounted || c.err != nil {
+		return c.mountPoint, c.err
+	}
+	if !c.device.Removable {
+		c.err = fmt.Errorf("not probing internal device %s", c.device.Node)
+		return "", c.err
+	}
+	c.mountPoint = currentSettings().paths.probeMountPoint(c.device.UUID)
+	if err := os.MkdirAll(c.mountPoint, 0777); err != nil { // Explicitly set permissions to 0777
+		c.err = fmt.Errorf("failed to create probe mount point %s: %v", c.mountPoint, err)
+		return "", c.err
+	}
+	output, err := exec.Command("mount", "-o", "ro", c.device.Node, c.mountPoint).CombinedOutput()
+	if err != nil {
+		c.err = fmt.Errorf("failed to mount %s to %s: %v\nOutput: %s", c.device.Node, c.mountPoint, err, output)
+		return "", c.err
+	}
+	c.mounted = true
+	return c.mountPoint, nil
+}
+
+// close unmounts the card if it was mounted.
+func (c *cardContent) close() {
+	if !c.mounted {
+		return
+	}
+	if output, err := exec.Command("umount", c.mountPoint).CombinedOutput(); err != nil {
+		logReceiver.WithField("output", string(output)).Warn("Error unmounting probe mount %s: %v", c.mountPoint, err)
+		return
+	}
+	os.Remove(c.mountPoint)
+}
+
+// hasFile reports whether a path exists on the card.
+func (c *cardContent) hasFile(relativePath string) bool {
+	root, err := c.root()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(root, filepath.Clean("/"+relativePath)))
+	return err == nil
+}
+
+// cardID returns the content of the card's .videoprocessor-id file.
+func (c *cardContent) cardID() string {
+	root, err := c.root()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(root, cardIDFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// matches reports whether the rule matches the device and how many criteria it checked.
+// Rules with more criteria are more specific and win over rules with fewer.
+func (m CardMatch) matches(device BlockDevice, content *cardContent) (bool, int) {
+	criteria := 0
+	check := func(expected, actual string) bool {
+		if expected == "" {
+			return true
+		}
+		criteria++
+		return expected == actual
+	}
+	if !check(m.UUID, device.UUID) || !check(m.Serial, device.Serial) ||
+		!check(m.Label, device.Label) || !check(m.PartLabel, device.PartLabel) {
+		return false, 0
+	}
+	// Only look at the files once the cheap criteria matched
+	if m.Marker != "" {
+		criteria++
+		if !content.hasFile(m.Marker) {
+			return false, 0
+		}
+	}
+	if m.CardID != "" && !check(m.CardID, content.cardID()) {
+		return false, 0
+	}
+	return criteria > 0, criteria
+}
+
+// matchRule returns the match rule of the card, which defaults to its key as the volume label.
+func (sdCard SDCard) matchRule(key string) CardMatch {
+	if sdCard.Match == nil {
+		return CardMatch{Label: key}
+	}
+	return *sdCard.Match
+}
+
+// identifyCard returns the key of the SDCard mapping that recognizes the device.
+// When several mappings match, the one with the most specific rule wins, then the first key.
+func identifyCard(device BlockDevice, mappings map[string]SDCard) (string, bool) {
+	keys := make([]string, 0, len(mappings))
+	for key := range mappings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	content := &cardContent{device: device}
+	defer content.close()
+
+	best, bestCriteria := "", 0
+	for _, key := range keys {
+		if matched, criteria := mappings[key].matchRule(key).matches(device, content); matched && criteria > bestCriteria {
+			best, bestCriteria = key, criteria
+		}
+	}
+	return best, best != ""
+}
+
+// writeCardID records the mapping name on a mounted card so later imports recognize it by its cardId.
+// Existing files are left alone, a write-protected card only logs a warning.
+func writeCardID(label string) {
+	path := filepath.Join(currentSettings().paths.cardMountPoint(label), cardIDFile)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	if err := os.WriteFile(path, []byte(label+"\n"), 0644); err != nil {
+		logReceiver.WithDevice(label).Warn("Could not write %s to card: %v", cardIDFile, err)
+		return
+	}
+	logReceiver.WithDevice(label).Info("Wrote %s to card %s", cardIDFile, label)
+}
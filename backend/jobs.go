@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobStage is a step of the ingest workflow for a single SD card.
+type JobStage string
+
+const (
+	StageMount   JobStage = "mount"
+	StageCopy    JobStage = "copy"
+	StageVerify  JobStage = "verify"
+	StageCatalog JobStage = "catalog"
+	StageProxy   JobStage = "proxy"
+	StageClear   JobStage = "clear"
+	StageEject   JobStage = "eject"
+	StageDone    JobStage = "done"
+)
+
+// stageOrder is the order in which the ingest stages run.
+var stageOrder = []JobStage{StageMount, StageCopy, StageVerify, StageCatalog, StageProxy, StageClear, StageEject, StageDone}
+
+// FileProgress records the state of a single file within an ingest job.
+type FileProgress struct {
+	Source      string                 `json:"source"`
+	Destination string                 `json:"destination"`        // Path of the original in the archive, which identifies it in the catalog
+	Location    string                 `json:"location,omitempty"` // Where the storage keeps the original, e.g. an s3:// URL
+	Size        int64                  `json:"size"`
+	SHA256      string                 `json:"sha256,omitempty"`
+	ModTime     time.Time              `json:"modTime"` // Modification time of the source when it was copied
+	Copied      bool                   `json:"copied"`
+	Verified    bool                   `json:"verified"`          // Destination digest matched the source, safe to clear
+	Backups     map[string]*BackupCopy `json:"backups,omitempty"` // Mirrored copies keyed by backup destination name
+}
+
+// BackupCopy records the copy of a file in one backup destination.
+type BackupCopy struct {
+	Location string `json:"location"`
+	SHA256   string `json:"sha256,omitempty"`
+	Verified bool   `json:"verified"` // Digest matched the archived original
+}
+
+// VerifiedCopies returns the number of verified copies of the file, counting the archive and every backup.
+func (f *FileProgress) VerifiedCopies() int {
+	copies := 0
+	if f.Verified {
+		copies++
+	}
+	for _, backup := range f.Backups {
+		if backup.Verified {
+			copies++
+		}
+	}
+	return copies
+}
+
+// IngestJob is the durable record of one SD card ingest.
+type IngestJob struct {
+	ID        string                   `json:"id"`
+	Label     string                   `json:"label"`
+	Stage     JobStage                 `json:"stage"`
+	Files     map[string]*FileProgress `json:"files"`               // Keyed by source path
+	Error     string                   `json:"error,omitempty"`     // Set when the job failed in Stage
+	Abandoned bool                     `json:"abandoned,omitempty"` // Given up, the next insert of the card starts a new job
+	CreatedAt time.Time                `json:"createdAt"`
+	UpdatedAt time.Time                `json:"updatedAt"`
+}
+
+// Finished reports whether the job has completed successfully.
+func (j *IngestJob) Finished() bool {
+	return j.Stage == StageDone
+}
+
+// Open reports whether the job may still be resumed: it has neither finished nor been abandoned.
+func (j *IngestJob) Open() bool {
+	return !j.Finished() && !j.Abandoned
+}
+
+// Passed reports whether the job has already completed the given stage.
+func (j *IngestJob) Passed(stage JobStage) bool {
+	return stageIndex(j.Stage) > stageIndex(stage)
+}
+
+// CopiedFiles returns the files that were copied by this job, sorted by source path.
+func (j *IngestJob) CopiedFiles() []*FileProgress {
+	var files []*FileProgress
+	for _, file := range j.Files {
+		if file.Copied {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Source < files[b].Source })
+	return files
+}
+
+// clone returns a deep copy of the job.
+func (j *IngestJob) clone() *IngestJob {
+	copied := *j
+	copied.Files = make(map[string]*FileProgress, len(j.Files))
+	for source, file := range j.Files {
+		progress := *file
+		if file.Backups != nil {
+			progress.Backups = make(map[string]*BackupCopy, len(file.Backups))
+			for name, backup := range file.Backups {
+				backupCopy := *backup
+				progress.Backups[name] = &backupCopy
+			}
+		}
+		copied.Files[source] = &progress
+	}
+	return &copied
+}
+
+// AllVerified reports whether every copied file was verified against its source digest.
+func (j *IngestJob) AllVerified() bool {
+	for _, file := range j.Files {
+		if file.Copied && !file.Verified {
+			return false
+		}
+	}
+	return true
+}
+
+func stageIndex(stage JobStage) int {
+	for i, s := range stageOrder {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// JobStore persists ingest jobs so they survive service restarts.
+// Open jobs are kept in a JSON file that is rewritten on every update, finished and abandoned jobs are appended
+// to a history file next to it so the updates written while copying stay small.
+// The store keeps its own copies of the jobs: a job returned by Begin belongs to the caller,
+// who records changes to it through Update.
+type JobStore struct {
+	mu          sync.Mutex
+	path        string
+	historyPath string
+	jobs        map[string]*IngestJob
+}
+
+// OpenJobStore loads the job store from path, creating an empty store if the file does not exist.
+func OpenJobStore(path string) (*JobStore, error) {
+	store := &JobStore{
+		path:        path,
+		historyPath: strings.TrimSuffix(path, filepath.Ext(path)) + "-history.jsonl",
+		jobs:        make(map[string]*IngestJob),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job store %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &store.jobs); err != nil {
+		return nil, fmt.Errorf("failed to decode job store %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// Begin returns the incomplete job for label if there is one, otherwise it creates a new job.
+// The boolean result is true when an existing job is being resumed.
+func (s *JobStore) Begin(label string) (*IngestJob, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job := s.activeLocked(label); job != nil {
+		// A failed job is retried from the stage it failed in
+		job.Error = ""
+		job.UpdatedAt = time.Now()
+		return job.clone(), true, s.saveLocked()
+	}
+
+	now := time.Now()
+	job := &IngestJob{
+		ID:        fmt.Sprintf("%s-%d", label, now.UnixNano()),
+		Label:     label,
+		Stage:     StageMount,
+		Files:     make(map[string]*FileProgress),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.jobs[job.ID] = job
+	return job.clone(), false, s.saveLocked()
+}
+
+// Update applies fn to job and persists a copy of the result.
+func (s *JobStore) Update(job *IngestJob, fn func(job *IngestJob)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.jobs[job.ID]; !exists {
+		return fmt.Errorf("job %s not found", job.ID)
+	}
+	fn(job)
+	return s.storeLocked(job)
+}
+
+// storeLocked persists a copy of job, moving it to the history once it is no longer open. The caller must hold s.mu.
+func (s *JobStore) storeLocked(job *IngestJob) error {
+	job.UpdatedAt = time.Now()
+	if !job.Open() {
+		if err := s.appendHistoryLocked(job); err != nil {
+			return err
+		}
+		delete(s.jobs, job.ID)
+	} else {
+		s.jobs[job.ID] = job.clone()
+	}
+	return s.saveLocked()
+}
+
+// SetStage moves the job to the given stage and persists it.
+func (s *JobStore) SetStage(job *IngestJob, stage JobStage) error {
+	return s.Update(job, func(job *IngestJob) {
+		job.Stage = stage
+	})
+}
+
+// Fail records the error that stopped the job in its current stage.
+func (s *JobStore) Fail(job *IngestJob, cause error) error {
+	return s.Update(job, func(job *IngestJob) {
+		job.Error = cause.Error()
+	})
+}
+
+// Abandon gives up the open job of a card, so its next ingest starts a new job.
+// It returns a copy of the abandoned job.
+func (s *JobStore) Abandon(label string) (*IngestJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := s.activeLocked(label)
+	if active == nil {
+		return nil, fmt.Errorf("no open ingest job for %s", label)
+	}
+	job := active.clone()
+	job.Abandoned = true
+	return job, s.storeLocked(job)
+}
+
+// Incomplete returns copies of all jobs that have not finished, oldest first.
+func (s *JobStore) Incomplete() []*IngestJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []*IngestJob
+	for _, job := range s.jobs {
+		jobs = append(jobs, job.clone())
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].CreatedAt.Before(jobs[b].CreatedAt) })
+	return jobs
+}
+
+// activeLocked returns the newest job for label. The caller must hold s.mu.
+func (s *JobStore) activeLocked(label string) *IngestJob {
+	var active *IngestJob
+	for _, job := range s.jobs {
+		if job.Label != label {
+			continue
+		}
+		if active == nil || job.CreatedAt.After(active.CreatedAt) {
+			active = job
+		}
+	}
+	return active
+}
+
+// appendHistoryLocked appends a finished or abandoned job to the history file. The caller must hold s.mu.
+func (s *JobStore) appendHistoryLocked(job *IngestJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to serialize job %s: %v", job.ID, err)
+	}
+	file, err := os.OpenFile(s.historyPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open job history: %v", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write job history: %v", err)
+	}
+	return file.Close()
+}
+
+// saveLocked atomically writes the open jobs to disk. The caller must hold s.mu.
+func (s *JobStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.jobs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize job store: %v", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write job store: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write job store: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync job store: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write job store: %v", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace job store: %v", err)
+	}
+	return nil
+}
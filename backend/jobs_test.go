@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestJobStore(t *testing.T) *JobStore {
+	t.Helper()
+	store, err := OpenJobStore(filepath.Join(t.TempDir(), "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestBeginResumesAtRecordedStage(t *testing.T) {
+	store := openTestJobStore(t)
+	job, resumed, err := store.Begin("GOPRO")
+	if err != nil || resumed {
+		t.Fatalf("first Begin: resumed %v, %v", resumed, err)
+	}
+	store.SetStage(job, StageVerify)
+	store.Fail(job, errors.New("destination unavailable"))
+
+	// The store reloads the job after a restart and resumes it where it failed
+	reopened, err := OpenJobStore(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, resumed, err := reopened.Begin("GOPRO")
+	if err != nil || !resumed || again.ID != job.ID {
+		t.Fatalf("Begin after a failed verify: job %s, resumed %v, %v", again.ID, resumed, err)
+	}
+	if again.Stage != StageVerify || again.Error != "" {
+		t.Fatalf("resumed job at %s with error %q", again.Stage, again.Error)
+	}
+}
+
+func TestJobStoreHandsOutCopies(t *testing.T) {
+	store := openTestJobStore(t)
+	job, _, _ := store.Begin("GOPRO")
+
+	// Changes that do not go through Update stay with the caller
+	job.Stage = StageClear
+	if incomplete := store.Incomplete(); incomplete[0].Stage != StageMount {
+		t.Fatalf("store sees unrecorded stage %s", incomplete[0].Stage)
+	}
+
+	store.Update(job, func(job *IngestJob) {
+		job.Files["/card/a.mp4"] = &FileProgress{Source: "/card/a.mp4", Copied: true}
+	})
+	incomplete := store.Incomplete()
+	if incomplete[0].Stage != StageClear || len(incomplete[0].Files) != 1 {
+		t.Fatalf("recorded job: %+v", incomplete[0])
+	}
+	incomplete[0].Files["/card/a.mp4"].Copied = false
+	if !store.Incomplete()[0].Files["/card/a.mp4"].Copied {
+		t.Fatal("a copy returned by Incomplete shares its files with the store")
+	}
+}
+
+func TestFinishedJobsMoveToHistory(t *testing.T) {
+	store := openTestJobStore(t)
+	job, _, _ := store.Begin("GOPRO")
+	if err := store.SetStage(job, StageDone); err != nil {
+		t.Fatal(err)
+	}
+	if incomplete := store.Incomplete(); len(incomplete) != 0 {
+		t.Fatalf("finished job is still open: %v", incomplete)
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), job.ID) {
+		t.Fatal("finished job is still in the job file")
+	}
+	history, err := os.ReadFile(store.historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(history)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], job.ID) {
+		t.Fatalf("job history: %s", history)
+	}
+
+	next, resumed, _ := store.Begin("GOPRO")
+	if resumed || next.ID == job.ID {
+		t.Fatal("Begin resumed a finished job")
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	store := openTestJobStore(t)
+	if _, err := store.Abandon("GOPRO"); err == nil {
+		t.Fatal("abandoned a job that does not exist")
+	}
+	job, _, _ := store.Begin("GOPRO")
+	store.SetStage(job, StageVerify)
+	store.Fail(job, errors.New("file moved"))
+	abandoned, err := store.Abandon("GOPRO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !abandoned.Abandoned || abandoned.ID != job.ID {
+		t.Fatalf("abandoned job: %+v", abandoned)
+	}
+	if incomplete := store.Incomplete(); len(incomplete) != 0 {
+		t.Fatalf("abandoned job is still open: %v", incomplete)
+	}
+
+	next, resumed, _ := store.Begin("GOPRO")
+	if resumed || next.ID == job.ID || next.Stage != StageMount {
+		t.Fatal("Begin resumed an abandoned job")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket upgrader
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// LogLevel is the severity of a log event.
+type LogLevel string
+
+const (
+	LevelDebug LogLevel = "debug"
+	LevelInfo  LogLevel = "info"
+	LevelWarn  LogLevel = "warn"
+	LevelError LogLevel = "error"
+)
+
+// LogEvent is a structured log entry. Consumers can filter on the device, job, stage and file it refers to.
+type LogEvent struct {
+	Type    string                 `json:"type"` // Always "log"
+	Time    time.Time              `json:"time"`
+	Level   LogLevel               `json:"level"`
+	Device  string                 `json:"device,omitempty"`
+	JobID   string                 `json:"job_id,omitempty"`
+	Stage   JobStage               `json:"stage,omitempty"`
+	File    string                 `json:"file,omitempty"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LogFormatter renders a log event for a consumer.
+type LogFormatter interface {
+	Format(event LogEvent) string
+}
+
+// textFormatter renders events as the "[timestamp] message" lines the log viewer has always shown.
+// Non-info levels and the device are prefixed to the message, fields are appended as key=value pairs.
+type textFormatter struct{}
+
+func (textFormatter) Format(event LogEvent) string {
+	timestamp := event.Time.In(currentSettings().timezone).Format("2006-01-02 15:04:05") // Use configured time zone
+	var prefix strings.Builder
+	if event.Level != LevelInfo {
+		fmt.Fprintf(&prefix, "%s: ", strings.ToUpper(string(event.Level)))
+	}
+	if event.Device != "" {
+		fmt.Fprintf(&prefix, "[%s] ", event.Device)
+	}
+	line := fmt.Sprintf("[%s] %s%s", timestamp, prefix.String(), event.Message)
+
+	keys := make([]string, 0, len(event.Fields))
+	for key := range event.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line += fmt.Sprintf(" %s=%v", key, event.Fields[key])
+	}
+	return line
+}
+
+// jsonFormatter renders events as JSON objects.
+type jsonFormatter struct{}
+
+func (jsonFormatter) Format(event LogEvent) string {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return textFormatter{}.Format(event)
+	}
+	return string(data)
+}
+
+// formatterFor returns the formatter selected by the ?format= query parameter of a WebSocket client, JSON by default.
+func formatterFor(r *http.Request) LogFormatter {
+	if r.URL.Query().Get("format") == "text" {
+		return textFormatter{}
+	}
+	return jsonFormatter{}
+}
+
+// Logger emits log events that share the same context, e.g. the device and job being processed.
+type Logger struct {
+	lr     *LogReceiver
+	base   LogEvent
+	job    *IngestJob
+	fields map[string]interface{}
+}
+
+// WithDevice returns a logger whose events refer to the given device.
+func (l Logger) WithDevice(device string) Logger {
+	l.base.Device = device
+	return l
+}
+
+// WithJob returns a logger whose events refer to the job, its device and the stage it is in when the event is logged.
+func (l Logger) WithJob(job *IngestJob) Logger {
+	l.job = job
+	l.base.Device = job.Label
+	l.base.JobID = job.ID
+	return l
+}
+
+// WithStage returns a logger whose events refer to the given stage.
+func (l Logger) WithStage(stage JobStage) Logger {
+	l.base.Stage = stage
+	return l
+}
+
+// WithFile returns a logger whose events refer to the given file.
+func (l Logger) WithFile(file string) Logger {
+	l.base.File = file
+	return l
+}
+
+// WithField returns a logger that adds a key/value pair to its events.
+func (l Logger) WithField(key string, value interface{}) Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	l.fields = fields
+	return l
+}
+
+// Debug logs a debug event.
+func (l Logger) Debug(format string, v ...interface{}) { l.emit(LevelDebug, format, v...) }
+
+// Info logs an informational event.
+func (l Logger) Info(format string, v ...interface{}) { l.emit(LevelInfo, format, v...) }
+
+// Warn logs a warning event.
+func (l Logger) Warn(format string, v ...interface{}) { l.emit(LevelWarn, format, v...) }
+
+// Error logs an error event.
+func (l Logger) Error(format string, v ...interface{}) { l.emit(LevelError, format, v...) }
+
+func (l Logger) emit(level LogLevel, format string, v ...interface{}) {
+	event := l.base
+	event.Type = "log"
+	event.Time = time.Now()
+	event.Level = level
+	event.Message = fmt.Sprintf(format, v...)
+	event.Fields = l.fields
+	if l.job != nil && event.Stage == "" {
+		event.Stage = l.job.Stage
+	}
+	l.lr.Emit(event)
+}
+
+// WebSocket client timing and queueing. A client that cannot keep up with its queue is disconnected;
+// it reconnects and receives the backfill again, so ingest never waits for a slow browser.
+const (
+	clientQueueSize = 256              // Messages buffered per client
+	storeQueueSize  = 1024             // Events buffered for the history writer
+	writeWait       = 10 * time.Second // Time allowed to write a message to a client
+	pongWait        = 60 * time.Second // Time allowed to read the next pong from a client
+	pingPeriod      = pongWait * 9 / 10
+)
+
+// LogReceiver handles centralized logging and WebSocket streaming.
+type LogReceiver struct {
+	clients map[*logClient]bool
+	mu      sync.Mutex
+	logs    []LogEvent // Retain the last log entries for the WebSocket backfill
+	console LogFormatter
+	store   chan LogEvent // Events waiting to be written to the history, nil until UseStore is called
+}
+
+// logClient is a connected WebSocket client. Its writer goroutine is the only one writing to conn.
+type logClient struct {
+	conn      *websocket.Conn
+	formatter LogFormatter
+	send      chan []byte
+	closeOnce sync.Once
+}
+
+// close stops the writer goroutine of the client, which closes the connection.
+func (c *logClient) close() {
+	c.closeOnce.Do(func() { close(c.send) })
+}
+
+// NewLogReceiver creates a new LogReceiver.
+func NewLogReceiver() *LogReceiver {
+	return &LogReceiver{
+		clients: make(map[*logClient]bool),
+		logs:    make([]LogEvent, 0, defaultLogBackfill),
+		console: textFormatter{},
+	}
+}
+
+// UseStore persists every log event to the store and seeds the backfill with the events logged before a restart.
+// Events are written by a separate goroutine, so a slow disk does not hold lr.mu.
+func (lr *LogReceiver) UseStore(store *LogStore) {
+	queue := make(chan LogEvent, storeQueueSize)
+	go func() {
+		for event := range queue {
+			if err := store.Append(event); err != nil {
+				log.Printf("Error persisting log event: %v", err)
+			}
+		}
+	}()
+
+	recent := store.Recent(logBackfillSize())
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	lr.store = queue
+	lr.logs = recent
+}
+
+// Emit logs a structured event to the server console, the history and the WebSocket clients.
+// It never waits for a client.
+func (lr *LogReceiver) Emit(event LogEvent) {
+	log.Println(lr.console.Format(event)) // Log to the server console
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if lr.store != nil {
+		select {
+		case lr.store <- event:
+		default:
+			log.Printf("Log history writer is behind, dropping event from the history")
+		}
+	}
+
+	// Add the log event to the in-memory log history
+	lr.logs = append(lr.logs, event)
+	if excess := len(lr.logs) - logBackfillSize(); excess > 0 {
+		lr.logs = lr.logs[excess:] // Remove the oldest logs if at capacity
+	}
+
+	for client := range lr.clients {
+		if !lr.enqueue(client, []byte(client.formatter.Format(event))) {
+			// The client missed a log event, disconnect it so it reloads the backfill
+			log.Printf("Disconnecting slow WebSocket client")
+			lr.removeLocked(client)
+		}
+	}
+}
+
+// Progress broadcasts a progress update as JSON to WebSocket clients without adding it to the history.
+// Progress updates are only sent to JSON clients and are dropped for clients whose queue is full,
+// since the next update supersedes them.
+func (lr *LogReceiver) Progress(event ProgressEvent) {
+	event.Type = "progress"
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding progress event: %v", err)
+		return
+	}
+	lr.publish(data)
+}
+
+// DeviceUpdate pushes the status of a card as JSON to WebSocket clients without adding it to the history.
+func (lr *LogReceiver) DeviceUpdate(device Device) {
+	device.Type = "device"
+	data, err := json.Marshal(device)
+	if err != nil {
+		log.Printf("Error encoding device status: %v", err)
+		return
+	}
+	lr.publish(data)
+}
+
+// publish queues a JSON status message for the JSON clients. It is dropped for clients whose queue is full.
+func (lr *LogReceiver) publish(data []byte) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for client := range lr.clients {
+		if _, isJSON := client.formatter.(jsonFormatter); isJSON {
+			lr.enqueue(client, data)
+		}
+	}
+}
+
+// enqueue queues a message for a client without blocking. It returns false if the client's queue is full.
+// The caller must hold lr.mu.
+func (lr *LogReceiver) enqueue(client *logClient, data []byte) bool {
+	select {
+	case client.send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// removeLocked forgets a client and stops its writer. The caller must hold lr.mu.
+func (lr *LogReceiver) removeLocked(client *logClient) {
+	if lr.clients[client] {
+		delete(lr.clients, client)
+		client.close()
+	}
+}
+
+// logger returns a logger without any context.
+func (lr *LogReceiver) logger() Logger {
+	return Logger{lr: lr}
+}
+
+// WithDevice returns a logger whose events refer to the given device.
+func (lr *LogReceiver) WithDevice(device string) Logger { return lr.logger().WithDevice(device) }
+
+// WithJob returns a logger whose events refer to the given ingest job.
+func (lr *LogReceiver) WithJob(job *IngestJob) Logger { return lr.logger().WithJob(job) }
+
+// WithFile returns a logger whose events refer to the given file.
+func (lr *LogReceiver) WithFile(file string) Logger { return lr.logger().WithFile(file) }
+
+// WithField returns a logger that adds a key/value pair to its events.
+func (lr *LogReceiver) WithField(key string, value interface{}) Logger {
+	return lr.logger().WithField(key, value)
+}
+
+// Debug logs a debug event without context.
+func (lr *LogReceiver) Debug(format string, v ...interface{}) { lr.logger().Debug(format, v...) }
+
+// Info logs an informational event without context.
+func (lr *LogReceiver) Info(format string, v ...interface{}) { lr.logger().Info(format, v...) }
+
+// Warn logs a warning event without context.
+func (lr *LogReceiver) Warn(format string, v ...interface{}) { lr.logger().Warn(format, v...) }
+
+// Error logs an error event without context.
+func (lr *LogReceiver) Error(format string, v ...interface{}) { lr.logger().Error(format, v...) }
+
+// HandleWebSocket handles WebSocket connections for log streaming.
+// Events are sent as JSON unless the client connects with ?format=text.
+func (lr *LogReceiver) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading WebSocket connection: %v", err)
+		http.Error(w, "Failed to upgrade WebSocket connection", http.StatusInternalServerError)
+		return
+	}
+
+	client := &logClient{
+		conn:      conn,
+		formatter: formatterFor(r),
+		send:      make(chan []byte, clientQueueSize+logBackfillSize()),
+	}
+
+	// Queue the recent log entries before registering the client, so the backfill precedes every live event
+	lr.mu.Lock()
+	for _, logEntry := range lr.logs {
+		lr.enqueue(client, []byte(client.formatter.Format(logEntry)))
+	}
+	lr.clients[client] = true
+	lr.mu.Unlock()
+
+	log.Printf("New WebSocket client connected")
+
+	go lr.writePump(client)
+	go lr.readPump(client)
+}
+
+// writePump writes queued messages and keepalive pings to a client until its queue is closed or a write fails.
+func (lr *LogReceiver) writePump(client *logClient) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		lr.mu.Lock()
+		lr.removeLocked(client)
+		lr.mu.Unlock()
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case data, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Error writing to WebSocket client: %v", err)
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Printf("Error pinging WebSocket client: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// readPump reads from a client to process pongs and detect disconnects.
+// A client that misses its pongs is considered gone.
+func (lr *LogReceiver) readPump(client *logClient) {
+	defer func() {
+		lr.mu.Lock()
+		lr.removeLocked(client)
+		lr.mu.Unlock()
+		log.Printf("WebSocket client disconnected")
+	}()
+
+	client.conn.SetReadLimit(512) // Clients never send anything but control frames
+	client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		if _, _, err := client.conn.ReadMessage(); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Unexpected WebSocket close error: %v", err)
+			} else {
+				log.Printf("WebSocket closed: %v", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log history is written to one JSON-lines file per day, e.g. logs/2024-06-01.jsonl next to the configuration.
+// Files older than the configured retention are deleted when the store rotates to a new day.
+const (
+	defaultLogBackfill      = 20 // Events replayed to a newly connected WebSocket client
+	defaultLogRetentionDays = 30
+	logFileExt              = ".jsonl"
+	logFileDateLayout       = "2006-01-02"
+)
+
+// logBackfillSize returns how many events are kept in memory and replayed to new WebSocket clients.
+func logBackfillSize() int {
+	if backfill := currentSettings().logBackfill; backfill > 0 {
+		return backfill
+	}
+	return defaultLogBackfill
+}
+
+// logRetention returns how many days of log history are kept on disk.
+func logRetention() int {
+	if days := currentSettings().logRetentionDays; days > 0 {
+		return days
+	}
+	return defaultLogRetentionDays
+}
+
+// logLevelRank orders the levels by severity.
+var logLevelRank = map[LogLevel]int{
+	LevelDebug: 0,
+	LevelInfo:  1,
+	LevelWarn:  2,
+	LevelError: 3,
+}
+
+// LogStore persists log events to daily files and answers queries over them.
+type LogStore struct {
+	mu   sync.Mutex
+	dir  string
+	day  string
+	file *os.File
+}
+
+// OpenLogStore opens the log history in dir, creating the directory if needed.
+func OpenLogStore(dir string) (*LogStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil { // Explicitly set permissions to 0777
+		return nil, fmt.Errorf("failed to create log directory %s: %v", dir, err)
+	}
+	s := &LogStore{dir: dir}
+	s.prune(time.Now())
+	return s, nil
+}
+
+// Append writes an event to the file of the day it happened.
+func (s *LogStore) Append(event LogEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize log event: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := event.Time.In(currentSettings().timezone).Format(logFileDateLayout)
+	if s.file == nil || day != s.day {
+		if s.file != nil {
+			s.file.Close()
+		}
+		file, err := os.OpenFile(filepath.Join(s.dir, day+logFileExt), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			s.file = nil
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		s.file, s.day = file, day
+		s.prune(event.Time)
+	}
+
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write log file: %v", err)
+	}
+	return nil
+}
+
+// prune deletes the files that are older than the retention.
+func (s *LogStore) prune(now time.Time) {
+	cutoff := now.In(currentSettings().timezone).AddDate(0, 0, -logRetention()).Format(logFileDateLayout)
+	for _, day := range s.days() {
+		if day < cutoff {
+			if err := os.Remove(filepath.Join(s.dir, day+logFileExt)); err != nil {
+				log.Printf("Error removing old log file %s: %v", day, err)
+			}
+		}
+	}
+}
+
+// days returns the days that have a log file, oldest first.
+func (s *LogStore) days() []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	var days []string
+	for _, entry := range entries {
+		day := strings.TrimSuffix(entry.Name(), logFileExt)
+		if entry.IsDir() || day == entry.Name() {
+			continue
+		}
+		if _, err := time.Parse(logFileDateLayout, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days
+}
+
+// readDay returns the events of one day in the order they were written. Unreadable lines are skipped.
+func (s *LogStore) readDay(day string) ([]LogEvent, error) {
+	file, err := os.Open(filepath.Join(s.dir, day+logFileExt))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []LogEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024) // ffmpeg output can make long lines
+	for scanner.Scan() {
+		var event LogEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Recent returns the last n events, oldest first.
+func (s *LogStore) Recent(n int) []LogEvent {
+	var recent []LogEvent
+	days := s.snapshot()
+	for i := len(days) - 1; i >= 0 && len(recent) < n; i-- {
+		events, err := s.readDay(days[i])
+		if err != nil {
+			continue
+		}
+		recent = append(events, recent...)
+	}
+	if len(recent) > n {
+		recent = recent[len(recent)-n:]
+	}
+	return recent
+}
+
+// LogQuery selects events from the history. Zero values match everything.
+type LogQuery struct {
+	From   time.Time
+	To     time.Time
+	Device string
+	JobID  string
+	Level  LogLevel // Minimum level
+	Text   string   // Case-insensitive search in the message and file
+}
+
+// matches reports whether an event is selected by the query.
+func (q LogQuery) matches(event LogEvent) bool {
+	switch {
+	case !q.From.IsZero() && event.Time.Before(q.From):
+	case !q.To.IsZero() && !event.Time.Before(q.To):
+	case q.Device != "" && event.Device != q.Device:
+	case q.JobID != "" && event.JobID != q.JobID:
+	case q.Level != "" && logLevelRank[event.Level] < logLevelRank[q.Level]:
+	case q.Text != "" && !strings.Contains(strings.ToLower(event.Message), q.Text) &&
+		!strings.Contains(strings.ToLower(event.File), q.Text):
+	default:
+		return true
+	}
+	return false
+}
+
+// snapshot returns the days that have a log file. The files are read without holding s.mu, so a query over a long
+// history does not block logging; a line that is still being appended is skipped as unreadable.
+func (s *LogStore) snapshot() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.days()
+}
+
+// Query returns up to max matching events, newest first. Reading stops once max events are found; max <= 0 returns
+// every match.
+func (s *LogStore) Query(q LogQuery, max int) ([]LogEvent, error) {
+	q.Text = strings.ToLower(q.Text)
+	var results []LogEvent
+	days := s.snapshot()
+	location := currentSettings().timezone
+	for i := len(days) - 1; i >= 0 && (max <= 0 || len(results) < max); i-- {
+		// Day files are named in the configured timezone, allow a day of slack for events near midnight
+		day, _ := time.ParseInLocation(logFileDateLayout, days[i], location)
+		if !q.From.IsZero() && day.AddDate(0, 0, 2).Before(q.From) {
+			break
+		}
+		if !q.To.IsZero() && day.AddDate(0, 0, -1).After(q.To) {
+			continue
+		}
+
+		events, err := s.readDay(days[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read log file %s: %v", days[i], err)
+		}
+		for j := len(events) - 1; j >= 0 && (max <= 0 || len(results) < max); j-- {
+			if q.matches(events[j]) {
+				results = append(results, events[j])
+			}
+		}
+	}
+	return results, nil
+}
+
+// ListLogs handles GET /api/logs. It supports from and to (RFC 3339 or yyyy-mm-dd), device, job, level (minimum),
+// q (text search), limit (default 100) and offset, and returns a page of the matching events newest first and whether
+// more follow it.
+func ListLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseQueryTime(query.Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(query.Get("to"))
+	if err != nil {
+		http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+		return
+	}
+	if !to.IsZero() && len(query.Get("to")) == len("2006-01-02") {
+		to = to.AddDate(0, 0, 1) // Include the whole day
+	}
+	level := LogLevel(query.Get("level"))
+	if _, exists := logLevelRank[level]; level != "" && !exists {
+		http.Error(w, fmt.Sprintf("Invalid level: %s", level), http.StatusBadRequest)
+		return
+	}
+
+	offset := 0
+	if value, err := strconv.Atoi(query.Get("offset")); err == nil && value > 0 {
+		offset = value
+	}
+	limit := 100
+	if value, err := strconv.Atoi(query.Get("limit")); err == nil && value > 0 {
+		limit = value
+	}
+
+	// One event more than the page tells whether there is a next page
+	results, err := logStore.Query(LogQuery{
+		From:   from,
+		To:     to,
+		Device: query.Get("device"),
+		JobID:  query.Get("job"),
+		Level:  level,
+		Text:   query.Get("q"),
+	}, offset+limit+1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	more := len(results) > limit
+	if more {
+		results = results[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		More bool       `json:"more"`
+		Logs []LogEvent `json:"logs"`
+	}{more, results})
+}
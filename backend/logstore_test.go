@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// openTestLogStore returns a store with one event per hour over two days, the first at midnight UTC.
+func openTestLogStore(t *testing.T) *LogStore {
+	t.Helper()
+	store, err := OpenLogStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	for i := 0; i < 48; i++ {
+		event := LogEvent{Type: "log", Time: start.Add(time.Duration(i) * time.Hour), Level: LevelInfo, Message: fmt.Sprintf("event %d", i)}
+		if err := store.Append(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestLogQueryStopsAtMax(t *testing.T) {
+	store := openTestLogStore(t)
+
+	events, err := store.Query(LogQuery{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for i, want := range []string{"event 47", "event 46", "event 45"} {
+		if events[i].Message != want {
+			t.Errorf("event %d = %q, want %q", i, events[i].Message, want)
+		}
+	}
+
+	all, err := store.Query(LogQuery{Text: "EVENT 1"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 11 { // event 1 and event 10 to 19
+		t.Errorf("got %d events matching the text, want 11", len(all))
+	}
+}
+
+func TestRecentReadsAcrossDays(t *testing.T) {
+	store := openTestLogStore(t)
+
+	recent := store.Recent(30)
+	if len(recent) != 30 {
+		t.Fatalf("got %d events, want 30", len(recent))
+	}
+	if recent[0].Message != "event 18" || recent[29].Message != "event 47" {
+		t.Errorf("got %q to %q, want event 18 to event 47", recent[0].Message, recent[29].Message)
+	}
+}
+
+func TestLogReceiverPersistsEvents(t *testing.T) {
+	store, err := OpenLogStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr := NewLogReceiver()
+	lr.UseStore(store)
+	lr.WithDevice("GOPRO").Info("Card inserted")
+
+	// The history is written in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, err := store.Query(LogQuery{Device: "GOPRO"}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == 1 && events[0].Message == "Card inserted" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v, want the logged event", events)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -3,197 +3,244 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/http"
 	"path/filepath"
-	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 // Config represents the structure of the configuration file.
 type Config struct {
-	SDCardMappings    map[string]SDCard `json:"sdCardMappings"`
-	IgnoredExtensions []string          `json:"ignoredExtensions"`
-	Timezone          string            `json:"timezone"`
-	DestinationConfig DestinationConfig `json:"destinationConfig"`
+	SDCardMappings    map[string]SDCard        `json:"sdCardMappings"`
+	IgnoredExtensions []string                 `json:"ignoredExtensions"`
+	Timezone          string                   `json:"timezone"`
+	DestinationConfig DestinationConfig        `json:"destinationConfig"`
+	Paths             PathsConfig              `json:"paths,omitempty"`
+	FreeSpace         SpaceConfig              `json:"freeSpace,omitempty"`     // Reserve kept free on the destinations, checked before copying a card
+	Originals         StorageConfig            `json:"originals,omitempty"`     // Where original footage is archived, defaults to files below the destination path
+	DeviceWatcher     string                   `json:"deviceWatcher,omitempty"` // "auto", "inotify", "netlink" or "poll"
+	ProxyProfiles     map[string]ProxyProfile  `json:"proxyProfiles,omitempty"`
+	CameraProfiles    map[string]CameraProfile `json:"cameraProfiles,omitempty"`    // Added to or replacing the built-in camera profiles
+	PreviewProfile    string                   `json:"previewProfile,omitempty"`    // Profile shown in the browser, defaults to "preview"
+	ProxyInputFormats []string                 `json:"proxyInputFormats,omitempty"` // ffprobe format names accepted as proxy sources
+	TranscodeWorkers  int                      `json:"transcodeWorkers,omitempty"`  // Concurrent ffmpeg processes, defaults to 1
+	LogBackfill       int                      `json:"logBackfill,omitempty"`       // Log events replayed to new WebSocket clients, defaults to 20
+	LogRetentionDays  int                      `json:"logRetentionDays,omitempty"`  // Days of log history kept on disk, defaults to 30
 }
 
 type DestinationConfig struct {
-	Type string `json:"type"` // "local" or "nfs"
-	Path string `json:"path"`
+	Type       string `json:"type"`                 // "local" or "nfs"
+	Path       string `json:"path"`                 // Archive root that relative destinations are resolved against
+	Server     string `json:"server,omitempty"`     // NFS server, leave empty when the share is mounted outside the processor
+	Export     string `json:"export,omitempty"`     // Exported path on the NFS server
+	Options    string `json:"options,omitempty"`    // NFS mount options, e.g. "vers=4.1,soft,timeo=100"
+	MountPoint string `json:"mountPoint,omitempty"` // Where the share is mounted, defaults to the path
 }
 
-var sdCardMappings map[string]SDCard
-var ignoredExtensions []string
-var timezone *time.Location
-var destinationConfig DestinationConfig
-
-// WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// Settings is the configuration the processor runs with. loadConfig replaces it as a whole and it is never changed
+// in place, so a reader that takes one snapshot with currentSettings sees values that belong together.
+type Settings struct {
+	sdCardMappings    map[string]SDCard
+	ignoredExtensions []string
+	timezone          *time.Location
+	destinationConfig DestinationConfig
+	paths             Paths
+	spaceConfig       SpaceConfig
+	originals         Storage
+	deviceWatcherType string
+	proxyProfiles     map[string]ProxyProfile
+	cameraProfiles    map[string]CameraProfile
+	previewProfile    string
+	proxyInputFormats []string
+	transcodeWorkers  int
+	logBackfill       int
+	logRetentionDays  int
 }
 
-// LogReceiver handles centralized logging and WebSocket streaming.
-type LogReceiver struct {
-	clients   map[*websocket.Conn]bool
-	broadcast chan string
-	mu        sync.Mutex
-	logs      []string // Retain the last 20 log entries
-}
+var activeSettings atomic.Pointer[Settings]
 
-// NewLogReceiver creates a new LogReceiver.
-func NewLogReceiver() *LogReceiver {
-	return &LogReceiver{
-		clients:   make(map[*websocket.Conn]bool),
-		broadcast: make(chan string),
-		logs:      make([]string, 0, 20), // Preallocate space for 20 logs
+// currentSettings returns the running configuration. It must not be modified.
+func currentSettings() *Settings {
+	if settings := activeSettings.Load(); settings != nil {
+		return settings
 	}
+	paths := resolvePaths(Config{})
+	return &Settings{timezone: time.Local, paths: paths, originals: &localStorage{root: paths.ArchiveRoot}} // Before the configuration is loaded
 }
 
-// Start starts the LogReceiver to handle broadcasting logs.
-func (lr *LogReceiver) Start() {
-	go func() {
-		for message := range lr.broadcast {
-			lr.mu.Lock()
-			// Add the log message to the in-memory log history
-			if len(lr.logs) == 20 {
-				lr.logs = lr.logs[1:] // Remove the oldest log if at capacity
-			}
-			lr.logs = append(lr.logs, message)
-
-			// Broadcast the log message to all connected clients
-			for client := range lr.clients {
-				err := client.WriteMessage(websocket.TextMessage, []byte(message))
-				if err != nil {
-					log.Printf("Error writing to WebSocket client: %v", err)
-					client.Close()
-					delete(lr.clients, client)
-				}
-			}
-			lr.mu.Unlock()
-		}
-	}()
-}
-
-// Log logs a message with a timestamp in the configured time zone and broadcasts it to WebSocket clients.
-func (lr *LogReceiver) Log(format string, v ...interface{}) {
-	timestamp := time.Now().In(timezone).Format("2006-01-02 15:04:05") // Use configured time zone
-	message := fmt.Sprintf("[%s] %s", timestamp, fmt.Sprintf(format, v...))
-	log.Println(message) // Log to the server console
-	lr.broadcast <- message
-}
-
-// HandleWebSocket handles WebSocket connections for log streaming.
-func (lr *LogReceiver) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Error upgrading WebSocket connection: %v", err)
-		http.Error(w, "Failed to upgrade WebSocket connection", http.StatusInternalServerError)
-		return
-	}
-
-	lr.mu.Lock()
-	lr.clients[conn] = true
-
-	// Send the last 20 log entries to the newly connected client
-	for _, logEntry := range lr.logs {
-		err := conn.WriteMessage(websocket.TextMessage, []byte(logEntry))
-		if err != nil {
-			log.Printf("Error sending log history to WebSocket client: %v", err)
-			conn.Close()
-			delete(lr.clients, conn)
-			lr.mu.Unlock()
-			return
-		}
-	}
-	lr.mu.Unlock()
+var logReceiver = NewLogReceiver()
+var logStore *LogStore
 
-	log.Printf("New WebSocket client connected")
+// configPath is the location of the configuration file loaded at startup
+var configPath = "/root/config/config.json"
 
-	// Keep the connection open and listen for client disconnects
-	go func() {
-		defer func() {
-			lr.mu.Lock()
-			delete(lr.clients, conn)
-			lr.mu.Unlock()
-			conn.Close()
-			log.Printf("WebSocket client disconnected")
-		}()
-
-		for {
-			// Read messages from the client to detect disconnects
-			if _, _, err := conn.ReadMessage(); err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("Unexpected WebSocket close error: %v", err)
-				} else {
-					log.Printf("WebSocket closed: %v", err)
-				}
-				break
-			}
-		}
-	}()
-}
+// jobStore persists ingest jobs across restarts
+var jobStore *JobStore
 
-var logReceiver = NewLogReceiver()
+// catalog holds the metadata of imported clips
+var catalog *Catalog
 
-// Global variable to store the NFS mount path
-var nfsMountPath string = "/media/nfs"
+// transcodeQueue renders proxies in the background
+var transcodeQueue *TranscodeQueue
 
-// Updated getDestinationPath to use the dynamic NFS mount path
+// getDestinationPath resolves a destination folder relative to the archive root
 func getDestinationPath(subPath string) (string, error) {
-	return filepath.Join(nfsMountPath, "video_archive", subPath), nil
+	return currentSettings().paths.archivePath(subPath), nil
 }
 
 func main() {
 	// Load configuration at startup
-	configPath := "/root/config/config.json"
 	if err := loadConfig(configPath); err != nil {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	// Start the log receiver
-	logReceiver.Start()
+	// Persist the log history next to the configuration file
+	var err error
+	logStore, err = OpenLogStore(filepath.Join(filepath.Dir(configPath), "logs"))
+	if err != nil {
+		log.Fatalf("Error opening log store: %v", err)
+	}
+	logReceiver.UseStore(logStore)
+
+	// Open the ingest job store next to the configuration file
+	jobStore, err = OpenJobStore(filepath.Join(filepath.Dir(configPath), "jobs.json"))
+	if err != nil {
+		log.Fatalf("Error opening job store: %v", err)
+	}
+	// Open the media catalog and add any files imported before it existed
+	catalog, err = OpenCatalog(filepath.Join(filepath.Dir(configPath), "catalog.json"))
+	if err != nil {
+		log.Fatalf("Error opening media catalog: %v", err)
+	}
+
+	// Start the proxy transcoding workers and queue the proxies that were lost when the processor last stopped
+	transcodeQueue = NewTranscodeQueue(currentSettings().transcodeWorkers)
+	transcodeQueue.Start()
+	go func() {
+		catalog.Backfill()
+		requeueMissingProxies()
+	}()
+
+	for _, job := range jobStore.Incomplete() {
+		logReceiver.WithJob(job).Info("Found incomplete ingest job %s for %s at stage %s, it will resume when the card is connected", job.ID, job.Label, job.Stage)
+	}
+
+	// Check the archive destination now and periodically, remounting the NFS share when needed
+	if err := ensureDestination(); err != nil {
+		logReceiver.Error("Imports are paused until the destination is available: %v", err)
+	}
+	go monitorDestination()
 
 	// Start the combined server (declared in web.go)
 	go StartServer()
 
-	// Continuous SD card processing
-	var wg sync.WaitGroup
-
-	for {
-		time.Sleep(5 * time.Second)
+	// Watch for SD cards being inserted and removed
+	watcher, err := newDeviceWatcher(currentSettings().deviceWatcherType)
+	if err != nil {
+		log.Fatalf("Error creating device watcher: %v", err)
+	}
+	events, err := watcher.Start()
+	if err != nil {
+		log.Fatalf("Error starting device watcher: %v", err)
+	}
 
-		// Detect connected devices
-		devices := getConnectedDevices()
+	runDeviceLoop(events, ingestDevice)
+}
 
-		// Remove devices that are no longer connected from the processedDevices map
-		for label := range processedDevices {
-			if !contains(devices, label) {
-				delete(processedDevices, label) // Remove from processedDevices if physically removed
-				logReceiver.Log("Removed %s from processed devices", label)
-			}
+// ingestDevice runs the ingest workflow for a card claimed in the device registry and records its outcome.
+func ingestDevice(device string) {
+	defer func() {
+		if r := recover(); r != nil {
+			logReceiver.WithDevice(device).Error("Recovered from panic while processing device %s: %v", device, r)
+			devices.Finish(device, fmt.Errorf("panic: %v", r))
 		}
+	}()
+	logReceiver.WithDevice(device).Info("Processing SD card: %s", device)
+	devices.Finish(device, processSDCard(device))
+	logReceiver.WithDevice(device).Info("Finished processing SD card: %s", device)
+}
+
+// probeResult is what the device loop learns about a device that was added.
+type probeResult struct {
+	id         string
+	device     BlockDevice
+	label      string   // Key of the mapping that recognized the device, "" if none did
+	sourceDirs []string // Folders that look like footage on a removable card no mapping recognized
+	err        error
+}
+
+// identifyDevice probes a device that was added and finds the mapping that recognizes it.
+// Match rules on the card content mount the card, so the device loop runs it in its own goroutine.
+func identifyDevice(id string, mappings map[string]SDCard) probeResult {
+	device, err := probeDevice(id)
+	if err != nil {
+		return probeResult{id: id, err: err}
+	}
+	label, exists := identifyCard(device, mappings)
+	if exists || !device.Removable {
+		return probeResult{id: id, device: device, label: label}
+	}
+	content := &cardContent{device: device}
+	defer content.close()
+	return probeResult{id: id, device: device, sourceDirs: detectSourceDirs(content)}
+}
 
-		// Process each newly detected device
-		for _, device := range devices {
-			if !processedDevices[device] {
-				wg.Add(1) // Increment the WaitGroup counter
-				go func(device string) {
-					defer func() {
-						// Ensure Done() is called even if a panic occurs
-						if r := recover(); r != nil {
-							logReceiver.Log("Recovered from panic while processing device %s: %v", device, r)
-						}
-						wg.Done() // Decrement the WaitGroup counter
-					}()
-					logReceiver.Log("Processing SD card: %s", device)
-					processSDCard(device)
-					logReceiver.Log("Finished processing SD card: %s", device)
-				}(device)
+// runDeviceLoop consumes device events until the channel is closed.
+// Added devices are probed and identified by the match rules of the mappings in their own goroutine, which posts
+// the result back to the loop, so a card that is slow to mount does not hold up the events of the others.
+// Unrecognized cards are offered for claiming, cards with a mapping are claimed in the device registry and handed
+// to process in their own goroutine, removed cards are marked as such so they are processed again on the next insert.
+func runDeviceLoop(events <-chan DeviceEvent, process func(label string)) {
+	probing := make(map[string]bool) // Devices whose probe result is still wanted
+	probes := 0                      // Probe goroutines that have not posted their result yet
+	results := make(chan probeResult)
+	for events != nil || probes > 0 {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				events = nil // Wait for the running probes, they block until their result is received
+				continue
+			}
+			switch event.Type {
+			case DeviceAdded:
+				if probing[event.ID] {
+					continue
+				}
+				probing[event.ID] = true
+				probes++
+				go func(id string, mappings map[string]SDCard) {
+					results <- identifyDevice(id, mappings)
+				}(event.ID, currentSettings().sdCardMappings)
+			case DeviceRemoved:
+				delete(probing, event.ID) // Drops the result of a probe that is still running
+				if label, exists := devices.Removed(event.ID); exists {
+					logReceiver.WithDevice(label).Info("Device %s was removed", label)
+				}
+			}
+		case result := <-results:
+			probes--
+			if !probing[result.id] {
+				continue // Removed while it was probed
+			}
+			delete(probing, result.id)
+			if result.err != nil {
+				logReceiver.Warn("%v", result.err)
+				continue
+			}
+			device, label := result.device, result.label
+			if label == "" && !device.Removable {
+				continue // Internal disks are never offered for claiming
+			}
+			if label == "" {
+				// Offer the card for claiming with the folders that look like footage
+				devices.AddUnknown(UnknownDevice{Block: device, SourceDirs: result.sourceDirs, DetectedAt: time.Now()})
+				logReceiver.Info("Detected unknown device %s (%s, label %q), waiting to be claimed", device.Node, device.UUID, device.Label)
+				continue
+			}
+			if !devices.Claim(label, device) {
+				continue
 			}
+			logReceiver.WithDevice(label).Info("Detected new device: %s (%s)", label, device.Node)
+			go process(label)
 		}
 	}
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain sets up the globals that loadConfig and main normally set before anything logs.
+func TestMain(m *testing.M) {
+	flag.Parse()
+	paths := resolvePaths(Config{})
+	activeSettings.Store(&Settings{timezone: time.UTC, paths: paths, originals: &localStorage{root: paths.ArchiveRoot}})
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// useTestSettings runs the test with a copy of the running configuration changed by change.
+func useTestSettings(t *testing.T, change func(settings *Settings)) {
+	t.Helper()
+	previous := currentSettings()
+	settings := *previous
+	change(&settings)
+	activeSettings.Store(&settings)
+	t.Cleanup(func() { activeSettings.Store(previous) })
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MediaInfo describes an imported clip as reported by ffprobe.
+type MediaInfo struct {
+	Path         string    `json:"path"`
+	Card         string    `json:"card"`
+	Format       string    `json:"format"` // ffprobe format name, e.g. "mov,mp4,m4a,3gp,3g2,mj2" or "mpegts"
+	Size         int64     `json:"size"`
+	Duration     float64   `json:"duration"` // Seconds
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	FrameRate    float64   `json:"frameRate"`
+	VideoCodec   string    `json:"videoCodec"`
+	VideoStreams int       `json:"videoStreams"` // Dual-fisheye cameras record one stream per lens
+	AudioCodec   string    `json:"audioCodec"`
+	Bitrate      int64     `json:"bitrate"` // Bits per second
+	CreationTime time.Time `json:"creationTime"`
+	Latitude     *float64  `json:"latitude,omitempty"`
+	Longitude    *float64  `json:"longitude,omitempty"`
+	ImportedAt   time.Time `json:"importedAt"`
+}
+
+// ffprobeOutput is the subset of `ffprobe -print_format json -show_format -show_streams` that is cataloged.
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		Tags         map[string]string `json:"tags"`
+		Disposition  struct {
+			AttachedPic int `json:"attached_pic"`
+		} `json:"disposition"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string            `json:"format_name"`
+		Duration   string            `json:"duration"`
+		BitRate    string            `json:"bit_rate"`
+		Size       string            `json:"size"`
+		Tags       map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// probeMedia runs ffprobe on path and extracts the cataloged metadata.
+func probeMedia(path string) (*MediaInfo, error) {
+	cmd := exec.Command(
+		"ffprobe", "-v", "quiet",
+		"-print_format", "json",
+		"-show_format", "-show_streams",
+		path,
+	)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe %s: %v", path, err)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("failed to decode ffprobe output for %s: %v", path, err)
+	}
+
+	info := &MediaInfo{Path: path, Format: probe.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	info.Size, _ = strconv.ParseInt(probe.Format.Size, 10, 64)
+
+	tags := probe.Format.Tags
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			if stream.Disposition.AttachedPic == 1 {
+				continue // Cover art, not footage
+			}
+			info.VideoStreams++
+			if info.VideoCodec == "" {
+				info.VideoCodec = stream.CodecName
+				info.Width = stream.Width
+				info.Height = stream.Height
+				info.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+		}
+		if tags == nil {
+			tags = stream.Tags
+		}
+	}
+
+	if created, err := time.Parse(time.RFC3339Nano, tags["creation_time"]); err == nil {
+		info.CreationTime = created
+	}
+	for _, key := range []string{"location", "com.apple.quicktime.location.ISO6709", "location-eng"} {
+		if lat, lon, ok := parseISO6709(tags[key]); ok {
+			info.Latitude, info.Longitude = &lat, &lon
+			break
+		}
+	}
+
+	return info, nil
+}
+
+// parseFrameRate parses an ffprobe rational like "30000/1001".
+func parseFrameRate(rate string) float64 {
+	numerator, denominator, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(numerator, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(denominator, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// parseISO6709 parses the "+37.7749-122.4194+010.000/" location format written by phones and action cameras.
+func parseISO6709(value string) (float64, float64, bool) {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "/")
+	if len(value) < 4 || (value[0] != '+' && value[0] != '-') {
+		return 0, 0, false
+	}
+
+	// Split at each sign after the first character: latitude, longitude and optional altitude
+	var parts []string
+	start := 0
+	for i := 1; i < len(value); i++ {
+		if value[i] == '+' || value[i] == '-' {
+			parts = append(parts, value[start:i])
+			start = i
+		}
+	}
+	parts = append(parts, value[start:])
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+
+	lat, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	lon, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// Catalog stores the metadata of every imported clip in a JSON file keyed by archive path.
+type Catalog struct {
+	mu          sync.Mutex
+	path        string
+	entries     map[string]*MediaInfo
+	pending     int  // Entries added since the catalog was last written
+	backfilling bool // A scan of the destinations is running
+	scanned     bool // A scan of the destinations has completed, so the catalog lists every imported file
+}
+
+// catalogBatchSize is how many entries are added before the catalog is written,
+// so a large archive is not rewritten for every file.
+const catalogBatchSize = 100
+
+// OpenCatalog loads the catalog from path, creating an empty catalog if the file does not exist.
+func OpenCatalog(path string) (*Catalog, error) {
+	catalog := &Catalog{
+		path:    path,
+		entries: make(map[string]*MediaInfo),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &catalog.entries); err != nil {
+		return nil, fmt.Errorf("failed to decode catalog %s: %v", path, err)
+	}
+	return catalog, nil
+}
+
+// Add probes the file at path and stores its metadata.
+// The catalog is written every catalogBatchSize entries, callers Flush it once they added their files.
+func (c *Catalog) Add(path, card string) (*MediaInfo, error) {
+	info, err := describeOriginal(path, card)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[path] = info
+	if c.pending++; c.pending >= catalogBatchSize {
+		if saveErr := c.saveLocked(); saveErr != nil {
+			return info, saveErr
+		}
+	}
+	return info, err
+}
+
+// describeOriginal probes the original at path for its catalog entry. When probing fails
+// a minimal entry is returned along with the error, so the file is still listed.
+func describeOriginal(path, card string) (*MediaInfo, error) {
+	info, err := probeMedia(mediaSource(path))
+	if err != nil {
+		info = &MediaInfo{}
+	}
+	info.Path = path
+	if stored, statErr := currentSettings().statOriginal(path); statErr == nil {
+		info.Size = stored.Size
+		if info.CreationTime.IsZero() {
+			info.CreationTime = stored.ModTime
+		}
+	}
+	info.Card = card
+	info.ImportedAt = time.Now()
+	return info, err
+}
+
+// Flush writes the catalog to disk if entries were added since it was last written.
+func (c *Catalog) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == 0 {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+// Move updates the path of a cataloged file after it was moved in the archive.
+func (c *Catalog) Move(oldPath, newPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info, exists := c.entries[oldPath]
+	if !exists {
+		return nil
+	}
+	delete(c.entries, oldPath)
+	info.Path = newPath
+	c.entries[newPath] = info
+	return c.saveLocked()
+}
+
+// Remove drops a file from the catalog.
+func (c *Catalog) Remove(path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.entries[path]; !exists {
+		return nil
+	}
+	delete(c.entries, path)
+	return c.saveLocked()
+}
+
+// Get returns a copy of the catalog entry for path.
+func (c *Catalog) Get(path string) (MediaInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info, exists := c.entries[path]
+	if !exists {
+		return MediaInfo{}, false
+	}
+	return *info, true
+}
+
+// Contains reports whether path is cataloged.
+func (c *Catalog) Contains(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, exists := c.entries[path]
+	return exists
+}
+
+// All returns a copy of every catalog entry.
+func (c *Catalog) All() []MediaInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]MediaInfo, 0, len(c.entries))
+	for _, info := range c.entries {
+		entries = append(entries, *info)
+	}
+	return entries
+}
+
+// Scanned reports whether a scan of the destinations has completed and no rescan is running,
+// so the catalog lists every imported file.
+func (c *Catalog) Scanned() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scanned && !c.backfilling
+}
+
+// Backfill catalogs files in the card destinations that were imported before the catalog existed
+// or were added to them outside of an ingest, and drops entries whose file is gone.
+// Only one backfill runs at a time, it returns false when another one is already running.
+func (c *Catalog) Backfill() bool {
+	if !c.beginBackfill() {
+		return false
+	}
+	c.backfill()
+	return true
+}
+
+// beginBackfill marks a backfill as running. It returns false when one already is.
+func (c *Catalog) beginBackfill() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.backfilling {
+		return false
+	}
+	c.backfilling = true
+	return true
+}
+
+// backfill runs a backfill started with beginBackfill.
+func (c *Catalog) backfill() {
+	defer func() {
+		c.mu.Lock()
+		c.backfilling = false
+		c.scanned = true
+		c.mu.Unlock()
+	}()
+
+	settings := currentSettings()
+	for _, info := range c.All() {
+		if !settings.originalExists(info.Path) { // Not under c.mu, the storage may be a remote bucket
+			c.mu.Lock()
+			delete(c.entries, info.Path)
+			c.pending++
+			c.mu.Unlock()
+		}
+	}
+
+	added := 0
+	for _, sdCard := range settings.sdCardMappings {
+		for _, path := range cardFiles(sdCard) {
+			if c.Contains(path) {
+				continue
+			}
+			if _, err := c.Add(path, sdCard.Name); err != nil {
+				logReceiver.WithDevice(sdCard.Name).WithFile(path).Error("Error cataloging %s: %v", path, err)
+			}
+			added++
+		}
+		c.flush()
+	}
+	c.flush()
+	if added > 0 {
+		logReceiver.WithField("count", added).Info("Cataloged %d existing files", added)
+	}
+}
+
+// flush writes the catalog to disk, logging failures.
+func (c *Catalog) flush() {
+	if err := c.Flush(); err != nil {
+		logReceiver.Error("Error saving catalog: %v", err)
+	}
+}
+
+// cardFiles lists the originals stored in the card's destination.
+func cardFiles(sdCard SDCard) []string {
+	settings := currentSettings()
+	objects, err := settings.listOriginals(destinationRoot(sdCard))
+	if err != nil {
+		logReceiver.WithDevice(sdCard.Name).Error("Error listing originals of %s: %v", sdCard.Name, err)
+		return nil
+	}
+	var paths []string
+	for _, object := range objects {
+		path := settings.archivePathOf(object.Name)
+		if !sdCard.ownsPath(path) || shouldIgnoreFile(path) {
+			continue // Footage of another card sharing the root, or a file the catalog skips
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// saveLocked atomically writes the catalog to disk. The caller must hold c.mu.
+func (c *Catalog) saveLocked() error {
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize catalog: %v", err)
+	}
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write catalog: %v", err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return fmt.Errorf("failed to replace catalog: %v", err)
+	}
+	c.pending = 0
+	return nil
+}
+
+// catalogFiles adds every file copied by the job to the catalog and writes it once they are all added.
+func catalogFiles(sdCard SDCard, job *IngestJob) {
+	defer catalog.flush()
+	logger := logReceiver.WithJob(job)
+	for _, file := range job.CopiedFiles() {
+		if catalog.Contains(file.Destination) {
+			continue
+		}
+		info, err := catalog.Add(file.Destination, sdCard.Name)
+		if err != nil {
+			logger.WithFile(file.Destination).Error("Error cataloging %s: %v", file.Destination, err)
+			continue
+		}
+		logger.WithFile(file.Destination).Info("Cataloged %s: %.1fs %dx%d %s", file.Destination, info.Duration, info.Width, info.Height, info.VideoCodec)
+	}
+}
+
+// mediaSortKeys maps the sort query parameter of /api/media to a comparison.
+var mediaSortKeys = map[string]func(a, b *MediaInfo) bool{
+	"path":         func(a, b *MediaInfo) bool { return a.Path < b.Path },
+	"card":         func(a, b *MediaInfo) bool { return a.Card < b.Card },
+	"size":         func(a, b *MediaInfo) bool { return a.Size < b.Size },
+	"duration":     func(a, b *MediaInfo) bool { return a.Duration < b.Duration },
+	"height":       func(a, b *MediaInfo) bool { return a.Height < b.Height },
+	"frameRate":    func(a, b *MediaInfo) bool { return a.FrameRate < b.FrameRate },
+	"bitrate":      func(a, b *MediaInfo) bool { return a.Bitrate < b.Bitrate },
+	"creationTime": func(a, b *MediaInfo) bool { return a.CreationTime.Before(b.CreationTime) },
+	"importedAt":   func(a, b *MediaInfo) bool { return a.ImportedAt.Before(b.ImportedAt) },
+}
+
+// ListMedia handles GET /api/media. Supported query parameters:
+// card, codec, q (text in path), from/to (creation date, RFC 3339 or yyyy-mm-dd),
+// minDuration/maxDuration (seconds), minHeight, gps=true, sort, order=asc|desc, limit and offset.
+func ListMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseQueryTime(query.Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+	to, err := parseQueryTime(query.Get("to"))
+	if err != nil {
+		http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+		return
+	}
+	if !to.IsZero() && len(query.Get("to")) == len("2006-01-02") {
+		to = to.AddDate(0, 0, 1) // Include the whole day
+	}
+	minDuration, _ := strconv.ParseFloat(query.Get("minDuration"), 64)
+	maxDuration, _ := strconv.ParseFloat(query.Get("maxDuration"), 64)
+	minHeight, _ := strconv.Atoi(query.Get("minHeight"))
+	text := strings.ToLower(query.Get("q"))
+
+	var results []*MediaInfo
+	for _, info := range catalog.All() {
+		switch {
+		case query.Get("card") != "" && info.Card != query.Get("card"):
+		case query.Get("codec") != "" && !strings.EqualFold(info.VideoCodec, query.Get("codec")):
+		case text != "" && !strings.Contains(strings.ToLower(info.Path), text):
+		case !from.IsZero() && info.CreationTime.Before(from):
+		case !to.IsZero() && !info.CreationTime.Before(to):
+		case minDuration > 0 && info.Duration < minDuration:
+		case maxDuration > 0 && info.Duration > maxDuration:
+		case minHeight > 0 && info.Height < minHeight:
+		case query.Get("gps") == "true" && info.Latitude == nil:
+		default:
+			results = append(results, &info)
+		}
+	}
+
+	sortKey := query.Get("sort")
+	if sortKey == "" {
+		sortKey = "creationTime"
+	}
+	less, exists := mediaSortKeys[sortKey]
+	if !exists {
+		http.Error(w, fmt.Sprintf("Invalid sort field: %s", sortKey), http.StatusBadRequest)
+		return
+	}
+	descending := query.Get("order") == "desc"
+	sort.SliceStable(results, func(i, j int) bool {
+		if descending {
+			return less(results[j], results[i])
+		}
+		return less(results[i], results[j])
+	})
+
+	total := len(results)
+	if offset, err := strconv.Atoi(query.Get("offset")); err == nil && offset > 0 {
+		if offset > len(results) {
+			offset = len(results)
+		}
+		results = results[offset:]
+	}
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 && limit < len(results) {
+		results = results[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Total int          `json:"total"`
+		Media []*MediaInfo `json:"media"`
+	}{total, results})
+}
+
+// RescanMedia handles POST /api/media/rescan. It scans the card destinations in the background to catalog
+// files added outside of an ingest and drop the entries of deleted files, then queues their missing proxies.
+func RescanMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !catalog.beginBackfill() {
+		http.Error(w, "A scan is already running", http.StatusConflict)
+		return
+	}
+	go func() {
+		catalog.backfill()
+		requeueMissingProxies()
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// parseQueryTime parses an RFC 3339 timestamp or a yyyy-mm-dd date in the configured timezone.
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, currentSettings().timezone)
+}
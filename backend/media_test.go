@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useTestCards maps two cards sharing a templated destination in a temporary archive and writes footage for them.
+func useTestCards(t *testing.T) string {
+	t.Helper()
+	root := useTestArchive(t)
+	useTestSettings(t, func(settings *Settings) {
+		settings.sdCardMappings = map[string]SDCard{
+			"OSMO":  {Name: "OSMO", Destination: "{date}_{card}"},
+			"GOPRO": {Name: "GOPRO", Destination: "{date}_{card}"},
+		}
+	})
+	for _, name := range []string{"2024-05-01_OSMO/DJI_0001.MP4", "2024-05-01_OSMO/DJI_0002.MP4", "2024-05-01_GOPRO/GX010001.MP4"} {
+		writeTestFile(t, filepath.Join(root, name), "footage")
+	}
+	return root
+}
+
+func openTestCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	c, err := OpenCatalog(filepath.Join(t.TempDir(), "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBackfill(t *testing.T) {
+	root := useTestCards(t)
+	c := openTestCatalog(t)
+	gone := filepath.Join(root, "2024-04-30_OSMO/DJI_0009.MP4")
+	c.entries[gone] = &MediaInfo{Path: gone, Card: "OSMO"}
+	if !c.Backfill() || !c.Scanned() {
+		t.Fatal("backfill did not complete")
+	}
+
+	reopened, err := OpenCatalog(c.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Contains(gone) {
+		t.Error("entry of a deleted file kept")
+	}
+	entries := reopened.All()
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	for _, info := range entries {
+		if card := strings.SplitN(filepath.Base(filepath.Dir(info.Path)), "_", 2)[1]; info.Card != card {
+			t.Errorf("%s cataloged for card %s", info.Path, info.Card)
+		}
+	}
+}
+
+func TestCatalogWritesInBatches(t *testing.T) {
+	root := t.TempDir()
+	c := openTestCatalog(t)
+	for i := 0; i < catalogBatchSize+1; i++ {
+		c.Add(filepath.Join(root, "missing", strings.Repeat("a", i+1)+".MP4"), "OSMO")
+	}
+	reopened, _ := OpenCatalog(c.path)
+	if count := len(reopened.All()); count != catalogBatchSize {
+		t.Fatalf("written after a full batch: %d entries", count)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ = OpenCatalog(c.path)
+	if count := len(reopened.All()); count != catalogBatchSize+1 {
+		t.Fatalf("written after flush: %d entries", count)
+	}
+}
+
+func TestListProxyFilesBeforeScan(t *testing.T) {
+	useTestCards(t)
+	savedCatalog := catalog
+	t.Cleanup(func() { catalog = savedCatalog })
+	catalog = openTestCatalog(t)
+
+	list := func() []ProxyFile {
+		recorder := httptest.NewRecorder()
+		ListProxyFiles(recorder, httptest.NewRequest(http.MethodGet, "/api/proxies", nil))
+		var proxies []ProxyFile
+		if err := json.Unmarshal(recorder.Body.Bytes(), &proxies); err != nil {
+			t.Fatal(err)
+		}
+		return proxies
+	}
+
+	// The catalog is still empty, the destinations are listed from disk
+	if proxies := list(); len(proxies) != 3 {
+		t.Fatalf("listed %d files before the scan, want 3", len(proxies))
+	}
+	catalog.Backfill()
+	if proxies := list(); len(proxies) != 3 {
+		t.Fatalf("listed %d files from the catalog, want 3", len(proxies))
+	}
+}
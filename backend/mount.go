@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// CardMounter mounts and unmounts SD cards at their mount points.
+type CardMounter interface {
+	IsMounted(mountPoint string) bool
+	Mount(devicePath, mountPoint string) error
+	Unmount(mountPoint string) error
+}
+
+// systemMounter uses the mount, umount and mountpoint commands.
+type systemMounter struct{}
+
+func (systemMounter) IsMounted(mountPoint string) bool {
+	return exec.Command("mountpoint", "-q", mountPoint).Run() == nil
+}
+
+func (systemMounter) Mount(devicePath, mountPoint string) error {
+	output, err := exec.Command("mount", devicePath, mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+func (systemMounter) Unmount(mountPoint string) error {
+	output, err := exec.Command("umount", mountPoint).CombinedOutput() // Capture both stdout and stderr
+	if err != nil {
+		return fmt.Errorf("%v\nOutput: %s", err, output)
+	}
+	return nil
+}
+
+// cardMounter mounts the cards. Tests replace it to run ingests on a folder standing in for a card.
+var cardMounter CardMounter = systemMounter{}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Default filesystem roots, matching the layout of the LXC container set up by proxmox_helper.sh.
+const (
+	defaultCardMountRoot = "/media/videoserver"
+	defaultArchiveRoot   = "/media/nfs/video_archive"
+	defaultInbox         = "RecentImports"
+)
+
+// PathsConfig overrides the filesystem roots. The archive root is the path of the destination config.
+type PathsConfig struct {
+	CardMountRoot string `json:"cardMountRoot,omitempty"` // Cards are mounted in a folder named after their mapping below this root
+	Inbox         string `json:"inbox,omitempty"`         // Folder in the archive that new imports land in, relative to the archive root
+	MediaRoot     string `json:"mediaRoot,omitempty"`     // Folder served at /media/, defaults to the archive root
+}
+
+// Paths are the resolved filesystem roots every component works below.
+type Paths struct {
+	CardMountRoot string
+	ArchiveRoot   string // Relative card destinations and destination folders live below this root
+	Inbox         string // Absolute path of the inbox folder
+	MediaRoot     string
+}
+
+// resolvePaths builds the filesystem roots from a configuration, filling in the defaults.
+func resolvePaths(config Config) Paths {
+	resolved := Paths{
+		CardMountRoot: config.Paths.CardMountRoot,
+		ArchiveRoot:   config.DestinationConfig.Path,
+		MediaRoot:     config.Paths.MediaRoot,
+	}
+	if resolved.CardMountRoot == "" {
+		resolved.CardMountRoot = defaultCardMountRoot
+	}
+	if resolved.ArchiveRoot == "" {
+		resolved.ArchiveRoot = defaultArchiveRoot
+	}
+	if resolved.MediaRoot == "" {
+		resolved.MediaRoot = resolved.ArchiveRoot
+	}
+	inbox := config.Paths.Inbox
+	if inbox == "" {
+		inbox = defaultInbox
+	}
+	resolved.Inbox = filepath.Join(resolved.ArchiveRoot, inbox)
+	return resolved
+}
+
+// validatePaths checks that the configured roots are absolute and the inbox lies inside the archive.
+func validatePaths(config Config) error {
+	roots := map[string]string{
+		"destination path": config.DestinationConfig.Path,
+		"cardMountRoot":    config.Paths.CardMountRoot,
+		"mediaRoot":        config.Paths.MediaRoot,
+	}
+	for name, root := range roots {
+		if root != "" && !filepath.IsAbs(root) {
+			return fmt.Errorf("%s must be an absolute path: %s", name, root)
+		}
+	}
+	if inbox := config.Paths.Inbox; filepath.IsAbs(inbox) || strings.HasPrefix(filepath.Clean(inbox), "..") {
+		return fmt.Errorf("inbox must be relative to the archive root: %s", inbox)
+	}
+	return nil
+}
+
+// cardMountPoint returns the folder the card with the given mapping name is mounted at.
+func (p Paths) cardMountPoint(label string) string {
+	return filepath.Join(p.CardMountRoot, label)
+}
+
+// probeMountPoint returns the folder an unidentified card is mounted at read-only while it is probed.
+func (p Paths) probeMountPoint(uuid string) string {
+	return filepath.Join(p.CardMountRoot, ".probe", uuid)
+}
+
+// archivePath resolves a path relative to the archive root. Absolute paths are returned cleaned.
+func (p Paths) archivePath(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(p.ArchiveRoot, path)
+}
+
+// mediaURL returns the URL a file below the media root is served at, or "" for files outside it.
+func (p Paths) mediaURL(path string) string {
+	relativePath, err := filepath.Rel(p.MediaRoot, path)
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return ""
+	}
+	return "/media/" + filepath.ToSlash(relativePath)
+}
+
+// mediaFile returns the file a /media/ URL refers to. Paths already below the media root are returned as they are.
+func (p Paths) mediaFile(url string) string {
+	if strings.HasPrefix(url, p.MediaRoot+string(filepath.Separator)) {
+		return filepath.Clean(url)
+	}
+	return filepath.Join(p.MediaRoot, filepath.Clean("/"+strings.TrimPrefix(url, "/media/")))
+}
+
+// displayName returns the path of an imported file as shown in the browser, relative to the inbox when it is inside.
+func (p Paths) displayName(path string) string {
+	return strings.TrimPrefix(path, p.Inbox+string(filepath.Separator))
+}
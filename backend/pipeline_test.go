@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeMounter stands in for mount and umount, treating the mount point folder as the card.
+type fakeMounter struct {
+	mounted map[string]bool
+	mounts  int
+}
+
+func (m *fakeMounter) IsMounted(mountPoint string) bool { return m.mounted[mountPoint] }
+
+func (m *fakeMounter) Mount(devicePath, mountPoint string) error {
+	m.mounted[mountPoint] = true
+	m.mounts++
+	return nil
+}
+
+func (m *fakeMounter) Unmount(mountPoint string) error {
+	delete(m.mounted, mountPoint)
+	return nil
+}
+
+// pipelineHarness points every root of the processor at temporary folders and archives into memory.
+type pipelineHarness struct {
+	mounter  *fakeMounter
+	cardRoot string
+}
+
+func newPipelineHarness(t *testing.T, sdCard SDCard) *pipelineHarness {
+	t.Helper()
+	useTestSettings(t, func(settings *Settings) {
+		settings.paths = resolvePaths(Config{
+			DestinationConfig: DestinationConfig{Path: filepath.Join(t.TempDir(), "archive")},
+			Paths:             PathsConfig{CardMountRoot: t.TempDir()},
+		})
+		settings.originals = newMemoryStorage()
+		settings.spaceConfig = SpaceConfig{Policy: SpaceWarn} // The reserve would refuse imports on a nearly full test disk
+		settings.sdCardMappings = map[string]SDCard{sdCard.Name: sdCard}
+	})
+	saved := struct {
+		devices        *DeviceRegistry
+		jobStore       *JobStore
+		catalog        *Catalog
+		transcodeQueue *TranscodeQueue
+		cardMounter    CardMounter
+	}{devices, jobStore, catalog, transcodeQueue, cardMounter}
+	t.Cleanup(func() {
+		devices, jobStore, catalog, transcodeQueue, cardMounter = saved.devices, saved.jobStore, saved.catalog, saved.transcodeQueue, saved.cardMounter
+	})
+
+	devices = NewDeviceRegistry()
+	jobStore = openTestJobStore(t)
+	var err error
+	if catalog, err = OpenCatalog(filepath.Join(t.TempDir(), "catalog.json")); err != nil {
+		t.Fatal(err)
+	}
+	transcodeQueue = NewTranscodeQueue(1) // Never started, proxies stay queued
+	h := &pipelineHarness{mounter: &fakeMounter{mounted: make(map[string]bool)}, cardRoot: currentSettings().paths.cardMountPoint(sdCard.Name)}
+	cardMounter = h.mounter
+
+	devices.Claim(sdCard.Name, BlockDevice{Node: "/dev/sdz1"})
+	return h
+}
+
+func (h *pipelineHarness) writeCardFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(h.cardRoot, filepath.FromSlash(name))
+	writeTestFile(t, path, content)
+	return path
+}
+
+func readOriginal(t *testing.T, name string) string {
+	t.Helper()
+	reader, err := currentSettings().originals.OpenRange(name, 0, -1)
+	if err != nil {
+		t.Fatalf("original %s: %v", name, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// finishedJob returns the job with the given ID from the job history.
+func finishedJob(t *testing.T, id string) *IngestJob {
+	t.Helper()
+	history, err := os.ReadFile(jobStore.historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(history)), "\n") {
+		var job IngestJob
+		if err := json.Unmarshal([]byte(line), &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.ID == id {
+			return &job
+		}
+	}
+	return nil
+}
+
+func TestIngestPipeline(t *testing.T) {
+	sdCard := SDCard{Name: "GOPRO", Profile: "gopro", Destination: "{card}"}
+	h := newPipelineHarness(t, sdCard)
+	clip := h.writeCardFile(t, "DCIM/100GOPRO/GX010001.MP4", "first clip")
+	second := h.writeCardFile(t, "DCIM/100GOPRO/GX010002.MP4", "second clip")
+	preview := h.writeCardFile(t, "DCIM/100GOPRO/GL010001.LRV", "low resolution preview")
+
+	if err := processSDCard("GOPRO"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy: every clip is archived below the card's destination, the ignored preview is not
+	if got := readOriginal(t, "GOPRO/GX010001.MP4"); got != "first clip" {
+		t.Errorf("archived GX010001.MP4 holds %q", got)
+	}
+	if got := readOriginal(t, "GOPRO/GX010002.MP4"); got != "second clip" {
+		t.Errorf("archived GX010002.MP4 holds %q", got)
+	}
+	if _, err := currentSettings().originals.Stat("GOPRO/GL010001.LRV"); !os.IsNotExist(err) {
+		t.Errorf("ignored preview was archived: %v", err)
+	}
+
+	// Verify: the job recorded a verified copy of each clip and finished
+	device, _ := devices.Get("GOPRO")
+	job := finishedJob(t, device.JobID)
+	if job == nil || job.Stage != StageDone {
+		t.Fatalf("job %s did not finish: %+v", device.JobID, job)
+	}
+	for _, source := range []string{clip, second} {
+		file := job.Files[source]
+		if file == nil || !file.Verified || file.SHA256 == "" {
+			t.Errorf("%s not recorded as verified: %+v", source, file)
+		}
+		if !catalog.Contains(file.Destination) {
+			t.Errorf("%s not cataloged", file.Destination)
+		}
+	}
+
+	// Clear: the copied clips are gone from the card, the ignored preview stays, and the card was ejected
+	for _, source := range []string{clip, second} {
+		if verifyFileExists(source) {
+			t.Errorf("%s left on the card", source)
+		}
+	}
+	if !verifyFileExists(preview) {
+		t.Error("ignored preview cleared from the card")
+	}
+	if h.mounter.mounts != 1 || h.mounter.IsMounted(h.cardRoot) {
+		t.Errorf("card mounted %d times, still mounted %v", h.mounter.mounts, h.mounter.IsMounted(h.cardRoot))
+	}
+}
+
+func TestIngestPipelineKeepsCardWithoutEnoughCopies(t *testing.T) {
+	sdCard := SDCard{Name: "GOPRO", Profile: "gopro", Destination: "{card}", RequiredCopies: 2,
+		Backups: []BackupDestination{{Name: "offsite", StorageConfig: StorageConfig{Root: filepath.Join(t.TempDir(), "offsite")}}}}
+	h := newPipelineHarness(t, sdCard)
+	clip := h.writeCardFile(t, "DCIM/100GOPRO/GX010001.MP4", "first clip")
+
+	// Make the backup unwritable so only the archive holds a copy
+	if err := os.WriteFile(sdCard.Backups[0].Root, []byte("not a folder"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := processSDCard("GOPRO"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOriginal(t, "GOPRO/GX010001.MP4"); got != "first clip" {
+		t.Errorf("archived GX010001.MP4 holds %q", got)
+	}
+	if !verifyFileExists(clip) {
+		t.Error("clip cleared from the card with one of two copies")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between two progress updates for the same file.
+const progressInterval = 500 * time.Millisecond
+
+// ProgressEvent reports how far a copy or a transcode of a single file has come.
+type ProgressEvent struct {
+	Type       string  `json:"type"` // Always "progress"
+	Kind       string  `json:"kind"` // "copy" or "transcode"
+	File       string  `json:"file"`
+	Device     string  `json:"device,omitempty"`
+	Profile    string  `json:"profile,omitempty"`
+	Percent    float64 `json:"percent"`
+	FPS        float64 `json:"fps,omitempty"`
+	ETASeconds float64 `json:"etaSeconds,omitempty"`
+	BytesDone  int64   `json:"bytesDone,omitempty"`
+	BytesTotal int64   `json:"bytesTotal,omitempty"`
+	Done       bool    `json:"done"`
+	Failed     bool    `json:"failed,omitempty"`
+}
+
+// progressThrottle limits how often progress updates are published.
+type progressThrottle struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// ready reports whether enough time has passed since the last published update.
+func (t *progressThrottle) ready() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.last) < progressInterval {
+		return false
+	}
+	t.last = time.Now()
+	return true
+}
+
+// progressWriter counts the bytes written through it and reports them to onProgress.
+type progressWriter struct {
+	written    int64
+	onProgress func(written int64)
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if w.onProgress != nil {
+		w.onProgress(w.written)
+	}
+	return len(p), nil
+}
+
+// copyProgressReporter returns a callback that publishes throttled copy progress for a file.
+func copyProgressReporter(device, file string, total int64) func(written int64) {
+	throttle := &progressThrottle{}
+	started := time.Now()
+	return func(written int64) {
+		if written < total && !throttle.ready() {
+			return
+		}
+		event := ProgressEvent{
+			Kind:       "copy",
+			File:       file,
+			Device:     device,
+			BytesDone:  written,
+			BytesTotal: total,
+			Done:       written >= total,
+		}
+		if total > 0 {
+			event.Percent = float64(written) / float64(total) * 100
+		}
+		if elapsed := time.Since(started).Seconds(); written > 0 && elapsed > 0 {
+			rate := float64(written) / elapsed
+			event.ETASeconds = float64(total-written) / rate
+		}
+		logReceiver.Progress(event)
+	}
+}
+
+// ffmpegProgress is the state reported by `ffmpeg -progress`.
+type ffmpegProgress struct {
+	OutTime float64 // Seconds of output rendered so far
+	FPS     float64
+	Ended   bool
+}
+
+// parseFFmpegProgress reads the key=value blocks written by `ffmpeg -progress pipe:1`
+// and calls onUpdate at the end of every block.
+func parseFFmpegProgress(r io.Reader, onUpdate func(ffmpegProgress)) {
+	var current ffmpegProgress
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "out_time_us", "out_time_ms": // Both are microseconds, out_time_ms is misnamed by ffmpeg
+			if us, err := strconv.ParseFloat(value, 64); err == nil && us >= 0 {
+				current.OutTime = us / 1e6
+			}
+		case "fps":
+			current.FPS, _ = strconv.ParseFloat(value, 64)
+		case "progress":
+			current.Ended = value == "end"
+			onUpdate(current)
+		}
+	}
+}
+
+// transcodeProgressReporter returns a callback that turns ffmpeg progress into throttled progress events.
+func transcodeProgressReporter(task *TranscodeTask, started time.Time, onPercent func(float64)) func(ffmpegProgress) {
+	throttle := &progressThrottle{}
+	return func(progress ffmpegProgress) {
+		if !progress.Ended && !throttle.ready() {
+			return
+		}
+		event := ProgressEvent{
+			Kind:    "transcode",
+			File:    task.Source,
+			Profile: task.Profile,
+			FPS:     progress.FPS,
+			Done:    progress.Ended,
+		}
+		if task.Duration > 0 {
+			event.Percent = progress.OutTime / task.Duration * 100
+			if event.Percent > 100 {
+				event.Percent = 100
+			}
+			if elapsed := time.Since(started).Seconds(); progress.OutTime > 0 && elapsed > 0 {
+				rate := progress.OutTime / elapsed // Seconds of output per second of wall time
+				event.ETASeconds = (task.Duration - progress.OutTime) / rate
+			}
+		}
+		if progress.Ended {
+			event.Percent = 100
+			event.ETASeconds = 0
+		}
+		onPercent(event.Percent)
+		logReceiver.Progress(event)
+	}
+}
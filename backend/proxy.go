@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ProxyProfile describes how ffmpeg renders one kind of proxy.
+type ProxyProfile struct {
+	VideoCodec string   `json:"videoCodec"`          // e.g. "libx264", "prores_ks", "dnxhd"
+	VideoArgs  []string `json:"videoArgs,omitempty"` // Rate control and codec options, e.g. ["-preset", "fast", "-crf", "23"]
+	Scale      string   `json:"scale,omitempty"`     // ffmpeg scale filter argument, e.g. "-1:720"
+	AudioCodec string   `json:"audioCodec,omitempty"`
+	AudioArgs  []string `json:"audioArgs,omitempty"` // e.g. ["-b:a", "128k"]
+	Container  string   `json:"container"`           // Output file extension, e.g. "mp4", "mov"
+	Folder     string   `json:"folder"`              // Subfolder next to the original that holds the output
+	Suffix     string   `json:"suffix,omitempty"`    // Appended to the original base name
+}
+
+// defaultProxyProfileName is the profile used for cards that do not select any and for the browser preview.
+const defaultProxyProfileName = "preview"
+
+// defaultProxyProfile is the H.264 720p proxy the processor has always generated.
+var defaultProxyProfile = ProxyProfile{
+	VideoCodec: "libx264",
+	VideoArgs:  []string{"-preset", "fast", "-crf", "23"},
+	Scale:      "-1:720", // Scale height to 720 and maintain aspect ratio
+	AudioCodec: "aac",
+	AudioArgs:  []string{"-b:a", "128k"},
+	Container:  "mp4",
+	Folder:     "Proxy",
+}
+
+// defaultProxyInputFormats are the ffprobe demuxer names accepted as proxy sources when none are configured.
+// QuickTime/MP4 covers .mp4, .mov and .insv files, mpegts covers Sony AVCHD .MTS.
+var defaultProxyInputFormats = []string{"mov", "mp4", "mpegts", "mxf", "matroska", "avi"}
+
+// acceptedProxyInput reports whether a probed file can be used as a proxy source.
+// The decision is based on the streams and the demuxer ffprobe picked, not on the file extension.
+func acceptedProxyInput(info MediaInfo) bool {
+	if info.VideoCodec == "" {
+		return false // No video stream, e.g. audio or sidecar data
+	}
+	accepted := currentSettings().proxyInputFormats
+	if len(accepted) == 0 {
+		accepted = defaultProxyInputFormats
+	}
+	// ffprobe reports every demuxer name that matches, e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	for _, format := range strings.Split(info.Format, ",") {
+		for _, acceptedFormat := range accepted {
+			if strings.EqualFold(format, acceptedFormat) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probeProxySource returns the stream information of a file, from the catalog when it is already known.
+func probeProxySource(path string) (MediaInfo, error) {
+	if info, exists := catalog.Get(path); exists && info.Format != "" {
+		return info, nil
+	}
+	info, err := probeMedia(mediaSource(path))
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	info.Path = path
+	return *info, nil
+}
+
+// namedProxyProfile pairs a profile with its configured name.
+type namedProxyProfile struct {
+	Name string
+	ProxyProfile
+}
+
+// lookupProxyProfile returns the profile with the given name, falling back to the built-in preview profile.
+func (s *Settings) lookupProxyProfile(name string) (ProxyProfile, bool) {
+	if profile, exists := s.proxyProfiles[name]; exists {
+		return profile, true
+	}
+	if name == defaultProxyProfileName {
+		return defaultProxyProfile, true
+	}
+	return ProxyProfile{}, false
+}
+
+// cardProxyProfiles returns the proxy profiles selected by the card or its camera profile,
+// or the preview profile when none are selected.
+func cardProxyProfiles(sdCard SDCard) []namedProxyProfile {
+	settings := currentSettings()
+	names := sdCard.ProxyProfiles
+	if len(names) == 0 {
+		names = sdCard.camera().ProxyProfiles
+	}
+	if len(names) == 0 {
+		names = []string{settings.previewProfileName()}
+	}
+
+	var profiles []namedProxyProfile
+	for _, name := range names {
+		profile, exists := settings.lookupProxyProfile(name)
+		if !exists {
+			logReceiver.WithDevice(sdCard.Name).Warn("Unknown proxy profile %s for SD card %s", name, sdCard.Name)
+			continue
+		}
+		profiles = append(profiles, namedProxyProfile{Name: name, ProxyProfile: profile})
+	}
+	return profiles
+}
+
+// allProxyProfiles returns every configured profile plus the built-in preview profile.
+func allProxyProfiles() []ProxyProfile {
+	profiles := []ProxyProfile{defaultProxyProfile}
+	for _, profile := range currentSettings().proxyProfiles {
+		profiles = append(profiles, profile)
+	}
+	return profiles
+}
+
+// previewProfileName returns the name of the profile shown in the browser.
+func (s *Settings) previewProfileName() string {
+	if s.previewProfile == "" {
+		return defaultProxyProfileName
+	}
+	return s.previewProfile
+}
+
+// proxyPathFor returns where the profile writes the proxy of the original file.
+func proxyPathFor(originalPath string, profile ProxyProfile) string {
+	name := filepath.Base(originalPath)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return filepath.Join(filepath.Dir(originalPath), profile.Folder, base+profile.Suffix+"."+profile.Container)
+}
+
+// legacyProxyPath returns where the preview proxy was written before proxy profiles existed: the Proxy folder
+// with the exact name of the original, e.g. Proxy/GX010001.MP4. Such proxies are still found but never written.
+func legacyProxyPath(originalPath string) string {
+	return filepath.Join(filepath.Dir(originalPath), defaultProxyProfile.Folder, filepath.Base(originalPath))
+}
+
+// proxyExists reports whether the profile's proxy of the original exists. For the built-in preview profile
+// a legacy proxy counts as well, so archives imported before proxy profiles existed are not rendered again.
+func proxyExists(originalPath string, profile namedProxyProfile) bool {
+	if verifyFileExists(proxyPathFor(originalPath, profile.ProxyProfile)) {
+		return true
+	}
+	return currentSettings().isBuiltinPreview(profile.Name) && verifyFileExists(legacyProxyPath(originalPath))
+}
+
+// isBuiltinPreview reports whether the profile with the given name is the built-in preview profile.
+func (s *Settings) isBuiltinPreview(name string) bool {
+	_, configured := s.proxyProfiles[name]
+	return name == defaultProxyProfileName && !configured
+}
+
+// previewProxyPath returns the path of the browser preview proxy of the original file,
+// or "" when it has not been rendered.
+func previewProxyPath(originalPath string) string {
+	settings := currentSettings()
+	name := settings.previewProfileName()
+	profile, _ := settings.lookupProxyProfile(name)
+	if proxyPath := proxyPathFor(originalPath, profile); verifyFileExists(proxyPath) {
+		return proxyPath
+	}
+	if legacyPath := legacyProxyPath(originalPath); settings.isBuiltinPreview(name) && verifyFileExists(legacyPath) {
+		return legacyPath
+	}
+	return ""
+}
+
+// isProxyFolder reports whether a folder name is the output folder of any proxy profile.
+func isProxyFolder(name string) bool {
+	for _, profile := range allProxyProfiles() {
+		if profile.Folder == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegArgs builds the ffmpeg arguments that render input into output with the profile.
+// Only the first video and audio streams are mapped, which keeps data tracks (timecode, GPS telemetry)
+// out of the proxy and renders a single lens of dual-fisheye recordings.
+func (p ProxyProfile) ffmpegArgs(input, output string) []string {
+	args := []string{"-i", input, "-map", "0:v:0"}
+	if p.AudioCodec != "" {
+		args = append(args, "-map", "0:a:0?")
+	}
+	if p.Scale != "" {
+		args = append(args, "-vf", "scale="+p.Scale)
+	}
+	args = append(args, "-c:v", p.VideoCodec)
+	args = append(args, p.VideoArgs...)
+	if p.AudioCodec != "" {
+		args = append(args, "-c:a", p.AudioCodec)
+		args = append(args, p.AudioArgs...)
+	} else {
+		args = append(args, "-an")
+	}
+	// The muxer is named explicitly since the output is rendered under a temporary name
+	return append(args, "-f", p.muxer(), output)
+}
+
+// muxer returns the ffmpeg muxer that writes the profile's container.
+func (p ProxyProfile) muxer() string {
+	switch container := strings.ToLower(p.Container); container {
+	case "m4v":
+		return "mp4"
+	case "mkv":
+		return "matroska"
+	case "mts", "m2ts", "ts":
+		return "mpegts"
+	default:
+		return container // e.g. "mp4", "mov", "mxf", "avi"
+	}
+}
+
+// validateProxyProfiles checks the profiles of a configuration and the profile references of its cards.
+func validateProxyProfiles(config Config) error {
+	for name, profile := range config.ProxyProfiles {
+		if profile.VideoCodec == "" || profile.Container == "" || profile.Folder == "" {
+			return fmt.Errorf("proxy profile %s needs a videoCodec, container and folder", name)
+		}
+		if strings.ContainsAny(profile.Folder, `/\`) || strings.HasPrefix(profile.Folder, ".") {
+			return fmt.Errorf("proxy profile %s has an invalid folder: %s", name, profile.Folder)
+		}
+	}
+
+	exists := func(name string) bool {
+		_, configured := config.ProxyProfiles[name]
+		return configured || name == defaultProxyProfileName
+	}
+	if config.PreviewProfile != "" && !exists(config.PreviewProfile) {
+		return fmt.Errorf("unknown preview profile: %s", config.PreviewProfile)
+	}
+	for label, sdCard := range config.SDCardMappings {
+		for _, name := range sdCard.ProxyProfiles {
+			if !exists(name) {
+				return fmt.Errorf("unknown proxy profile %s for %s", name, label)
+			}
+		}
+	}
+	return nil
+}
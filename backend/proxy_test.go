@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestProxyPathFor(t *testing.T) {
+	if got := proxyPathFor("/archive/GOPRO/GX010001.MP4", defaultProxyProfile); got != "/archive/GOPRO/Proxy/GX010001.mp4" {
+		t.Errorf("default profile: got %s", got)
+	}
+	prores := ProxyProfile{VideoCodec: "prores_ks", Container: "mov", Folder: "ProRes", Suffix: "_proxy"}
+	if got := proxyPathFor("/archive/SONY/C0001.MXF", prores); got != "/archive/SONY/ProRes/C0001_proxy.mov" {
+		t.Errorf("custom profile: got %s", got)
+	}
+}
+
+func TestLegacyPreviewProxy(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "GX010001.MP4")
+	writeTestFile(t, original, "footage")
+	preview := namedProxyProfile{Name: defaultProxyProfileName, ProxyProfile: defaultProxyProfile}
+
+	if previewProxyPath(original) != "" || proxyExists(original, preview) {
+		t.Fatal("found a proxy that was never rendered")
+	}
+
+	// Proxies rendered before proxy profiles existed kept the name of the original
+	legacy := filepath.Join(dir, "Proxy", "GX010001.MP4")
+	writeTestFile(t, legacy, "proxy")
+	if got := previewProxyPath(original); got != legacy {
+		t.Fatalf("preview proxy: got %q, want %s", got, legacy)
+	}
+	if !proxyExists(original, preview) {
+		t.Error("legacy proxy is rendered again")
+	}
+	other := namedProxyProfile{Name: "edit", ProxyProfile: ProxyProfile{Container: "mov", Folder: "Proxy"}}
+	if proxyExists(original, other) {
+		t.Error("legacy proxy counted for another profile")
+	}
+
+	// The legacy proxy of a moved or deleted original still takes its name
+	writeTestFile(t, filepath.Join(dir, "Proxy", "GX010002.MP4"), "proxy")
+	if !nameTaken(dir, "GX010002.MP4") {
+		t.Error("name of a legacy proxy is not taken")
+	}
+}
+
+func TestAcceptedProxyInput(t *testing.T) {
+	tests := []struct {
+		info     MediaInfo
+		accepted bool
+	}{
+		{MediaInfo{Format: "mov,mp4,m4a,3gp,3g2,mj2", VideoCodec: "h264"}, true},
+		{MediaInfo{Format: "mpegts", VideoCodec: "h264"}, true},
+		{MediaInfo{Format: "mxf", VideoCodec: "h264"}, true},
+		{MediaInfo{Format: "mov,mp4,m4a,3gp,3g2,mj2"}, false}, // No video stream
+		{MediaInfo{Format: "image2", VideoCodec: "mjpeg"}, false},
+	}
+	for _, test := range tests {
+		if accepted := acceptedProxyInput(test.info); accepted != test.accepted {
+			t.Errorf("%s/%s: got %v, want %v", test.info.Format, test.info.VideoCodec, accepted, test.accepted)
+		}
+	}
+}
+
+func TestPreviewProxyOfOtherContainers(t *testing.T) {
+	// Whatever the container of the original, the preview proxy is an H.264 MP4 the browser can play
+	for _, original := range []string{"/archive/SONY/C0001.MXF", "/archive/SONY/00001.MTS", "/archive/INSTA/VID_0001.insv"} {
+		output := proxyPathFor(original, defaultProxyProfile)
+		if filepath.Ext(output) != ".mp4" {
+			t.Errorf("%s: preview proxy %s", original, output)
+		}
+		args := defaultProxyProfile.ffmpegArgs(original, output)
+		if args[len(args)-1] != output {
+			t.Errorf("%s: ffmpeg does not write %s: %v", original, output, args)
+		}
+	}
+}
+
+func TestFFmpegArgsNameMuxer(t *testing.T) {
+	tests := map[string]string{"mp4": "mp4", "MOV": "mov", "mkv": "matroska", "mxf": "mxf"}
+	for container, muxer := range tests {
+		profile := ProxyProfile{VideoCodec: "libx264", Container: container, Folder: "Proxy"}
+		output := "/archive/Proxy/C0001." + container + partialSuffix
+		args := profile.ffmpegArgs("C0001.MXF", output)
+		if got := args[len(args)-3:]; got[0] != "-f" || got[1] != muxer || got[2] != output {
+			t.Errorf("%s: got %v, want -f %s", container, got, muxer)
+		}
+	}
+}
@@ -3,207 +3,413 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
 // SDCard represents the configuration for an SD card.
 type SDCard struct {
-	Name        string   `json:"name"`
-	SourceDirs  []string `json:"sourceDirs"`
-	Destination string   `json:"destination"`
+	Name              string              `json:"name"`
+	Profile           string              `json:"profile,omitempty"`    // Camera profile, e.g. "sony-xavc", that provides defaults for the settings below
+	SourceDirs        []string            `json:"sourceDirs,omitempty"` // Folders relative to the card root, may be globs such as DCIM/*GOPRO or DCIM/**
+	Include           []string            `json:"include,omitempty"`    // Only import files matching one of these patterns, e.g. "*.MP4"
+	Exclude           []string            `json:"exclude,omitempty"`    // Skip files matching one of these patterns, on top of the ignored extensions
+	Structure         string              `json:"structure,omitempty"`  // "flatten" (default) or "preserve" the folders matched by the source patterns
+	Destination       string              `json:"destination"`
+	ClearPolicy       string              `json:"clearPolicy,omitempty"`       // "never", "verified-only" (default) or "all"
+	Quarantine        bool                `json:"quarantine,omitempty"`        // Move cleared files to .imported on the card instead of deleting
+	CollisionStrategy string              `json:"collisionStrategy,omitempty"` // "skip-identical" (default), "suffix" or "timestamp"
+	ProxyProfiles     []string            `json:"proxyProfiles,omitempty"`     // Names of the proxy profiles to render, defaults to the preview profile
+	Match             *CardMatch          `json:"match,omitempty"`             // How the card is recognized, defaults to a volume label equal to the mapping key
+	Backups           []BackupDestination `json:"backups,omitempty"`           // Storages every original is mirrored to
+	RequiredCopies    int                 `json:"requiredCopies,omitempty"`    // Verified copies, counting the archive, needed before a file is cleared, defaults to all
 }
 
-var processedDevices = make(map[string]bool)
-
 // shouldIgnoreFile checks if a file should be ignored based on its extension.
 func shouldIgnoreFile(fileName string) bool {
-	lowerFileName := strings.ToLower(fileName) // Convert the file name to lowercase
-	for _, ext := range ignoredExtensions {
-		if strings.HasSuffix(lowerFileName, strings.ToLower(ext)) { // Convert the extension to lowercase
-			return true
-		}
-	}
-	return false
+	return matchesAnyFilter(extensionPatterns(currentSettings().ignoredExtensions), filepath.Base(fileName))
 }
 
-// getConnectedDevices retrieves a list of connected devices by scanning /dev/disk/by-label.
-func getConnectedDevices() []string {
-	devices := []string{}
-	files, err := os.ReadDir("/dev/disk/by-label")
+// copyFiles copies the files selected by the SD card's source patterns to the specified destination.
+// Every copied file is recorded in the job so an interrupted copy resumes where it stopped.
+// It returns a boolean indicating whether any files were copied.
+func copyFiles(sdCard SDCard, job *IngestJob) (bool, error) {
+	logger := logReceiver.WithJob(job)
+	filesCopied := false
+	settings := currentSettings()
+	files, err := scanSourceFiles(sdCard, settings.paths.cardMountPoint(sdCard.Name))
+	if err != nil {
+		return false, err
+	}
+	backups, err := sdCard.backupStorages()
 	if err != nil {
-		logReceiver.Log("Error reading /dev/disk/by-label: %v", err)
-		return devices
+		return false, err
 	}
 
+	// Copy each file individually
 	for _, file := range files {
-		name := file.Name()
-		if _, exists := sdCardMappings[name]; exists {
-			devices = append(devices, name) // Append the label to the devices list
-			if !processedDevices[name] {    // Only log if the device is not already processed
-				logReceiver.Log("Detected new device: %s", name)
+		if devices.Aborted(job.Label) {
+			return filesCopied, errIngestAborted
+		}
+
+		sourceFilePath := file.Path
+		destinationFileName := sdCard.importName(filepath.Base(file.Path)) // e.g. .insv becomes .mp4 for Insta360 cards
+		info := file.Info
+
+		// Skip files that an earlier run of this job already copied and verified
+		if progress, exists := job.Files[sourceFilePath]; exists && progress.Verified && progress.Size == info.Size() {
+			if stored, err := settings.statOriginal(progress.Destination); err == nil && stored.Size == progress.Size {
+				logger.WithFile(sourceFilePath).Info("Already copied: %s", sourceFilePath)
+				filesCopied = true
+				if err := mirrorFile(sdCard, job, backups, sourceFilePath, progress); err != nil {
+					return filesCopied, err
+				}
+				continue
 			}
 		}
-	}
-	return devices
-}
 
-// copyFiles copies files from the SD card's source directories to the specified destination.
-// It returns a boolean indicating whether any files were copied.
-func copyFiles(sdCard SDCard) (bool, error) {
-	filesCopied := false
-	for _, sourceDir := range sdCard.SourceDirs {
-		sdCardPath := filepath.Join("/media/videoserver", sdCard.Name, sourceDir)
+		// Never overwrite existing footage, cameras reuse file names after their counters reset.
+		// A resumed job copies to the name it recorded before, unless a different file took that name since.
+		var destinationDir, existingDigest string
+		if planned := plannedDestination(job, sourceFilePath, info); planned != "" {
+			destinationDir, destinationFileName = filepath.Dir(planned), filepath.Base(planned)
+		} else {
+			var captured time.Time
+			destinationDir, captured = sdCard.archiveDir(file)
+
+			// Ensure destination directory exists
+			if err := os.MkdirAll(destinationDir, 0777); err != nil { // Explicitly set permissions to 0777
+				return false, fmt.Errorf("failed to create destination directory: %v", err)
+			}
 
-		// Check if the source directory exists
-		if _, err := os.Stat(sdCardPath); os.IsNotExist(err) {
-			logReceiver.Log("Source directory does not exist: %s", sdCardPath)
-			continue // Skip this source directory
+			destinationFileName, existingDigest, err = resolveCollision(sdCard, sourceFilePath, destinationDir, destinationFileName, info, captured)
+			if err != nil {
+				return false, err
+			}
+		}
+		destinationFilePath := filepath.Join(destinationDir, destinationFileName)
+
+		digest, size := existingDigest, info.Size()
+		if existingDigest == "" {
+			// Record the name before copying, so a crash before the copy is recorded does not rename it on resume
+			err = jobStore.Update(job, func(job *IngestJob) {
+				job.Files[sourceFilePath] = &FileProgress{
+					Source:      sourceFilePath,
+					Destination: destinationFilePath,
+					Size:        info.Size(),
+					ModTime:     info.ModTime(),
+				}
+			})
+			if err != nil {
+				return false, fmt.Errorf("failed to record progress for %s: %v", sourceFilePath, err)
+			}
+			progress := copyProgressReporter(sdCard.Name, sourceFilePath, info.Size())
+			digest, err = storeOriginal(devices.Context(job.Label), sourceFilePath, destinationFilePath, info.Size(), progress)
+			if err != nil {
+				logReceiver.Progress(ProgressEvent{Kind: "copy", File: sourceFilePath, Device: sdCard.Name, Done: true, Failed: true})
+				return false, err
+			}
+			logger.WithFile(sourceFilePath).WithField("sha256", digest).Info("Copied and verified file: %s to %s", sourceFilePath, settings.originalLocation(destinationFilePath))
 		}
+		filesCopied = true
 
-		// List files in the source directory for debugging
-		files, err := os.ReadDir(sdCardPath)
-		if err != nil {
-			return false, fmt.Errorf("failed to read directory %s: %v", sdCardPath, err)
+		if err := recordManifest(destinationDir, destinationFileName, digest); err != nil {
+			return false, err
 		}
-		logReceiver.Log("Files found in %s: %v", sdCardPath, files)
 
-		// Ensure destination directory exists
-		err = os.MkdirAll(sdCard.Destination, 0777) // Explicitly set permissions to 0777
+		progress := &FileProgress{
+			Source:      sourceFilePath,
+			Destination: destinationFilePath,
+			Location:    settings.originalLocation(destinationFilePath),
+			Size:        size,
+			SHA256:      digest,
+			ModTime:     info.ModTime(),
+			Copied:      true,
+			Verified:    true,
+		}
+		err = jobStore.Update(job, func(job *IngestJob) {
+			job.Files[sourceFilePath] = progress
+		})
 		if err != nil {
-			return false, fmt.Errorf("failed to create destination directory: %v", err)
+			return false, fmt.Errorf("failed to record progress for %s: %v", sourceFilePath, err)
 		}
 
-		// Copy each file individually
-		for _, file := range files {
-			if file.IsDir() { // Skip directories
-				continue
-			}
+		// Mirror the file to the backup destinations while it is still on the card
+		if err := mirrorFile(sdCard, job, backups, sourceFilePath, progress); err != nil {
+			return false, err
+		}
+	}
+	return filesCopied, nil
+}
 
-			if shouldIgnoreFile(file.Name()) {
-				logReceiver.Log("Ignoring file: %s", file.Name())
-				continue // Skip copying ignored files
-			}
+// archiveDir returns the folder a source file is archived to and the capture time it was expanded with.
+func (sdCard SDCard) archiveDir(file sourceFile) (string, time.Time) {
+	// Expand the destination template with the capture time of this file
+	captured := file.Info.ModTime()
+	if hasDatePlaceholders(sdCard.Destination) || sdCard.collisionStrategy() == CollisionTimestamp {
+		captured = captureTime(file.Path, file.Info)
+	}
+	dir := expandDestination(sdCard.Destination, sdCard.Name, captured)
+	if sdCard.structure() == StructurePreserve {
+		dir = filepath.Join(dir, filepath.FromSlash(path.Dir(file.RelativePath)))
+	}
+	return dir, captured
+}
 
-			sourceFilePath := filepath.Join(sdCardPath, file.Name())
-			destinationFileName := file.Name()
+// plannedDestination returns the destination an earlier run of the job chose for a source file it did not finish copying.
+// It returns "" when there is none, or when the destination now holds a file that cannot be that copy.
+func plannedDestination(job *IngestJob, sourcePath string, source os.FileInfo) string {
+	progress, exists := job.Files[sourcePath]
+	if !exists || progress.Copied || progress.Destination == "" || progress.Size != source.Size() {
+		return ""
+	}
+	if existing, err := currentSettings().statOriginal(progress.Destination); err == nil && existing.Size != source.Size() {
+		return ""
+	}
+	return progress.Destination
+}
 
-			// Change .insv extension to .mp4
-			if strings.HasSuffix(strings.ToLower(file.Name()), ".insv") {
-				destinationFileName = strings.TrimSuffix(file.Name(), ".insv") + ".mp4"
-			}
+// createProxies queues proxy jobs for the originals stored below the card's destination
+// and, for templated destinations, every dated folder below it, once for every proxy profile of the card.
+// Files that cannot be downscaled are skipped without errors.
+func createProxies(sdCard SDCard, priority TranscodePriority) error {
+	settings := currentSettings()
+	objects, err := settings.listOriginals(destinationRoot(sdCard))
+	if err != nil {
+		return err
+	}
+	profiles := cardProxyProfiles(sdCard)
+	for _, object := range objects {
+		path := settings.archivePathOf(object.Name)
+		if !sdCard.ownsPath(path) {
+			continue // Footage of another card sharing the root
+		}
+		if err := queueProxies(path, profiles, priority); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueProxies queues a proxy job for every profile whose output does not exist yet.
+func queueProxies(originalFilePath string, profiles []namedProxyProfile, priority TranscodePriority) error {
+	var missing []namedProxyProfile
+	for _, profile := range profiles {
+		// Skip reprocessing if the proxy file already exists
+		if !proxyExists(originalFilePath, profile) {
+			missing = append(missing, profile)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// Attempt to create a proxy only for files whose streams are a supported video format
+	media, err := probeProxySource(originalFilePath)
+	if err != nil || !acceptedProxyInput(media) {
+		logReceiver.WithFile(originalFilePath).Info("Skipping proxy creation for unsupported file: %s", originalFilePath)
+		return nil
+	}
+	if media.VideoStreams > 1 {
+		logReceiver.WithFile(originalFilePath).Info("%s has %d video streams (dual-fisheye), the proxy uses the first one", originalFilePath, media.VideoStreams)
+	}
 
-			destinationFilePath := filepath.Join(sdCard.Destination, destinationFileName)
+	for _, profile := range missing {
+		proxyFilePath := proxyPathFor(originalFilePath, profile.ProxyProfile)
 
-			cmd := exec.Command("cp", sourceFilePath, destinationFilePath)
-			output, err := cmd.CombinedOutput() // Capture both stdout and stderr
-			if err != nil {
-				return false, fmt.Errorf("failed to copy file from %s to %s: %v\nOutput: %s", sourceFilePath, destinationFilePath, err, output)
+		// Create the proxy subfolder if it doesn't exist, only in folders that hold footage
+		if err := os.MkdirAll(filepath.Dir(proxyFilePath), 0777); err != nil { // Explicitly set permissions to 0777
+			return fmt.Errorf("failed to create %s folder: %v", profile.Folder, err)
+		}
+		if transcodeQueue.Enqueue(originalFilePath, proxyFilePath, profile.Name, profile.ProxyProfile, priority, media.Duration) {
+			logReceiver.WithFile(originalFilePath).WithField("profile", profile.Name).Debug("Queued %s proxy for %s", profile.Name, originalFilePath)
+		}
+	}
+	return nil
+}
+
+// requeueMissingProxies queues the proxies that are missing for cataloged originals. The transcode queue only lives
+// in memory, so this picks up the proxies that were still queued or rendering when the processor stopped.
+func requeueMissingProxies() {
+	mappings := currentSettings().sdCardMappings
+	for _, info := range catalog.All() {
+		if !acceptedProxyInput(info) {
+			continue // Not a video, or the probe failed when it was cataloged
+		}
+		for _, sdCard := range mappings {
+			if !sdCard.ownsPath(info.Path) {
+				continue
+			}
+			if err := queueProxies(info.Path, cardProxyProfiles(sdCard), PriorityReprocess); err != nil {
+				logReceiver.WithDevice(sdCard.Name).WithFile(info.Path).Error("Error queueing proxies for %s: %v", info.Path, err)
 			}
-			logReceiver.Log("Copied file: %s to %s", sourceFilePath, destinationFilePath)
-			filesCopied = true
+			break
 		}
 	}
-	return filesCopied, nil
 }
 
-// createProxies generates proxy files from the original media files in the destination directory.
-// Files that cannot be downscaled are skipped without errors.
-func createProxies(sdCard SDCard) error {
-	return createProxiesForDirectory(sdCard.Destination)
+// Clear policies for SDCard.ClearPolicy.
+const (
+	ClearNever        = "never"         // Leave the card untouched
+	ClearVerifiedOnly = "verified-only" // Remove only the files this ingest copied and verified (default)
+	ClearAll          = "all"           // Remove everything in the source directories
+)
+
+// quarantineDir is the folder at the root of the card that cleared files are moved into when quarantine is enabled.
+const quarantineDir = ".imported"
+
+// clearPolicy returns the effective clear policy of the card.
+func (sdCard SDCard) clearPolicy() string {
+	if sdCard.ClearPolicy == "" {
+		return ClearVerifiedOnly
+	}
+	return sdCard.ClearPolicy
 }
 
-// createProxiesForDirectory generates proxy files for a given directory.
-func createProxiesForDirectory(directory string) error {
-	if _, err := os.Stat(directory); err == nil {
-		files, err := os.ReadDir(directory)
-		if err != nil {
-			return fmt.Errorf("failed to read directory %s: %v", directory, err)
-		}
+// validClearPolicy reports whether policy is a known clear policy. An empty policy means the default.
+func validClearPolicy(policy string) bool {
+	switch policy {
+	case "", ClearNever, ClearVerifiedOnly, ClearAll:
+		return true
+	}
+	return false
+}
 
-		// Create the Proxy subfolder if it doesn't exist
-		proxyFolder := filepath.Join(directory, "Proxy")
-		if err := os.MkdirAll(proxyFolder, 0777); err != nil { // Explicitly set permissions to 0777
-			return fmt.Errorf("failed to create Proxy folder: %v", err)
-		}
+// clearSDCard removes imported files from the SD card according to the card's clear policy.
+// With quarantine enabled files are moved into the .imported folder on the card instead of being deleted.
+func clearSDCard(sdCard SDCard, job *IngestJob) error {
+	cardRoot := currentSettings().paths.cardMountPoint(sdCard.Name)
+	logger := logReceiver.WithJob(job)
 
-		for _, file := range files {
-			if file.IsDir() {
-				continue // Skip subdirectories
-			}
+	switch sdCard.clearPolicy() {
+	case ClearNever:
+		logger.Info("Clear policy for %s is %s, leaving files on the card", sdCard.Name, ClearNever)
+		return nil
 
-			originalFilePath := filepath.Join(directory, file.Name())
-			proxyFilePath := filepath.Join(proxyFolder, file.Name()) // Proxy file has the same name as the original
+	case ClearVerifiedOnly:
+		cleared := 0
+		for _, file := range job.CopiedFiles() {
+			if !file.Verified {
+				logger.WithFile(file.Source).Warn("Keeping unverified file on card: %s", file.Source)
+				continue
+			}
+			if copies := file.VerifiedCopies(); copies < sdCard.requiredCopies() {
+				logger.WithFile(file.Source).Warn("Keeping %s on card: %d of %d verified copies", file.Source, copies, sdCard.requiredCopies())
+				continue
+			}
 
-			// Skip reprocessing if the proxy file already exists
-			if _, err := os.Stat(proxyFilePath); err == nil {
+			// Never remove a file that changed after it was copied
+			info, err := os.Stat(file.Source)
+			if os.IsNotExist(err) {
+				continue // Already cleared by an earlier run of this job
+			}
+			if err != nil {
+				return fmt.Errorf("failed to stat %s on SD card %s: %v", file.Source, sdCard.Name, err)
+			}
+			if info.Size() != file.Size || (!file.ModTime.IsZero() && !info.ModTime().Equal(file.ModTime)) {
+				logger.WithFile(file.Source).Warn("Keeping %s on card: it changed after it was copied", file.Source)
 				continue
 			}
 
-			// Attempt to create a proxy only for supported file types
-			if strings.HasSuffix(strings.ToLower(file.Name()), ".mp4") {
-				cmd := exec.Command(
-					"ffmpeg", "-i", originalFilePath,
-					"-vf", "scale=-1:720", // Scale height to 720 and maintain aspect ratio
-					"-c:v", "libx264", "-preset", "fast", "-crf", "23",
-					"-c:a", "aac", "-b:a", "128k",
-					proxyFilePath,
-				)
-				output, err := cmd.CombinedOutput() // Capture both stdout and stderr
+			if err := removeFromCard(cardRoot, file.Source, sdCard.Quarantine); err != nil {
+				return fmt.Errorf("failed to clear %s on SD card %s: %v", file.Source, sdCard.Name, err)
+			}
+			cleared++
+		}
+		logger.WithField("cleared", cleared).Info("Cleared %d verified files on SD card: %s", cleared, sdCard.Name)
+
+	case ClearAll:
+		if !job.AllVerified() {
+			return fmt.Errorf("not clearing %s: some copied files were not verified", sdCard.Name)
+		}
+		for _, file := range job.CopiedFiles() {
+			if copies := file.VerifiedCopies(); copies < sdCard.requiredCopies() {
+				return fmt.Errorf("not clearing %s: %s has %d of %d verified copies", sdCard.Name, file.Source, copies, sdCard.requiredCopies())
+			}
+		}
+		for _, pattern := range sdCard.sourceDirs() {
+			sourceDirs, err := matchSourceDirs(cardRoot, pattern)
+			if err != nil {
+				return fmt.Errorf("failed to clear %s on SD card %s: %v", pattern, sdCard.Name, err)
+			}
+			for _, sourceDir := range sourceDirs {
+				sdCardPath := filepath.Join(cardRoot, filepath.FromSlash(sourceDir))
+				entries, err := os.ReadDir(sdCardPath)
+				if os.IsNotExist(err) {
+					continue // Removed with a parent folder matched by the same pattern
+				}
 				if err != nil {
-					logReceiver.Log("Failed to create proxy for %s: %v\nOutput: %s", originalFilePath, err, output)
-					continue // Move on to the next file
+					return fmt.Errorf("failed to read directory %s on SD card %s: %v", sourceDir, sdCard.Name, err)
+				}
+				for _, entry := range entries {
+					if isCardMetadata(path.Join(sourceDir, entry.Name())) {
+						continue
+					}
+					if err := removeFromCard(cardRoot, filepath.Join(sdCardPath, entry.Name()), sdCard.Quarantine); err != nil {
+						return fmt.Errorf("failed to clear directory %s on SD card %s: %v", sourceDir, sdCard.Name, err)
+					}
 				}
-				logReceiver.Log("Created proxy for %s", originalFilePath)
-			} else {
-				logReceiver.Log("Skipping proxy creation for unsupported file: %s", originalFilePath)
+				logger.Info("Cleared directory %s on SD card: %s", sourceDir, sdCard.Name)
 			}
 		}
+
+	default:
+		return fmt.Errorf("unknown clear policy %q for SD card %s", sdCard.ClearPolicy, sdCard.Name)
 	}
+
+	time.Sleep(2 * time.Second) // Add a delay after clearing files
 	return nil
 }
 
-// clearSDCard removes all files from the source directories on the SD card.
-func clearSDCard(sdCard SDCard) error {
-	for _, sourceDir := range sdCard.SourceDirs {
-		sdCardPath := filepath.Join("/media/videoserver", sdCard.Name, sourceDir)
-		cmd := exec.Command("find", sdCardPath, "-mindepth", "1", "-delete")
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to clear directory %s on SD card: %s", sourceDir, sdCard.Name)
-		}
-		logReceiver.Log("Cleared directory %s on SD card: %s", sourceDir, sdCard.Name)
+// removeFromCard deletes path from the card, or moves it below the quarantine folder keeping its relative location.
+func removeFromCard(cardRoot, path string, quarantine bool) error {
+	if !quarantine {
+		return os.RemoveAll(path)
 	}
-	time.Sleep(2 * time.Second) // Add a delay after clearing files
+
+	relativePath, err := filepath.Rel(cardRoot, path)
+	if err != nil {
+		return err
+	}
+	quarantinePath := filepath.Join(cardRoot, quarantineDir, relativePath)
+	if err := os.MkdirAll(filepath.Dir(quarantinePath), 0777); err != nil {
+		return err
+	}
+	if _, err := os.Stat(quarantinePath); err == nil {
+		// A file with the same name was quarantined by an earlier import
+		quarantinePath = fmt.Sprintf("%s.%d", quarantinePath, time.Now().Unix())
+	}
+	if err := os.Rename(path, quarantinePath); err != nil {
+		return err
+	}
+	logReceiver.WithFile(path).Info("Quarantined %s to %s", path, quarantinePath)
 	return nil
 }
 
 // isMounted checks if the device is mounted at the desired directory.
 func isMounted(label string) (bool, error) {
-	mountPoint := filepath.Join("/media/videoserver", label)
+	mountPoint := currentSettings().paths.cardMountPoint(label)
 
 	// Check if the mount point exists
 	if _, err := os.Stat(mountPoint); os.IsNotExist(err) {
-		logReceiver.Log("Mount point does not exist: %s", mountPoint)
+		logReceiver.WithDevice(label).Debug("Mount point does not exist: %s", mountPoint)
 		return false, nil
 	}
 
 	// Check if the device is actually mounted
-	cmd := exec.Command("mountpoint", "-q", mountPoint)
-	if err := cmd.Run(); err != nil {
-		logReceiver.Log("Device %s is not mounted at %s", label, mountPoint)
+	if !cardMounter.IsMounted(mountPoint) {
+		logReceiver.WithDevice(label).Debug("Device %s is not mounted at %s", label, mountPoint)
 		return false, nil
 	}
 
-	logReceiver.Log("Device %s is mounted at %s", label, mountPoint)
+	logReceiver.WithDevice(label).Info("Device %s is mounted at %s", label, mountPoint)
 	return true, nil
 }
 
-// mountDevice mounts the SD card to the desired directory.
-func mountDevice(label string) error {
-	devicePath := "/dev/disk/by-label/" + label
-	mountPoint := filepath.Join("/media/videoserver", label)
+// mountDevice mounts the SD card's device node to the desired directory.
+func mountDevice(label, devicePath string) error {
+	mountPoint := currentSettings().paths.cardMountPoint(label)
 
 	// Ensure the desired mount point exists
 	if err := os.MkdirAll(mountPoint, 0777); err != nil { // Explicitly set permissions to 0777
@@ -211,19 +417,17 @@ func mountDevice(label string) error {
 	}
 
 	// Mount the device manually to the desired directory
-	cmd := exec.Command("mount", devicePath, mountPoint)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to mount %s to %s: %v\nOutput: %s", devicePath, mountPoint, err, output)
+	if err := cardMounter.Mount(devicePath, mountPoint); err != nil {
+		return fmt.Errorf("failed to mount %s to %s: %v", devicePath, mountPoint, err)
 	}
 
-	logReceiver.Log("Successfully mounted device %s to %s", devicePath, mountPoint)
+	logReceiver.WithDevice(label).Info("Successfully mounted device %s to %s", devicePath, mountPoint)
 	return nil
 }
 
 // ejectSDCard unmounts the SD card using the umount command.
 func ejectSDCard(sdCard SDCard) error {
-	mountPoint := filepath.Join("/media/videoserver", sdCard.Name)
+	mountPoint := currentSettings().paths.cardMountPoint(sdCard.Name)
 
 	// Check if the device is actually mounted before attempting to unmount
 	mounted, err := isMounted(sdCard.Name)
@@ -231,117 +435,190 @@ func ejectSDCard(sdCard SDCard) error {
 		return fmt.Errorf("error checking mount status for %s: %v", sdCard.Name, err)
 	}
 	if !mounted {
-		logReceiver.Log("Device %s is not mounted. Skipping unmount.", sdCard.Name)
+		logReceiver.WithDevice(sdCard.Name).Info("Device %s is not mounted. Skipping unmount.", sdCard.Name)
 		return nil
 	}
 
-	cmd := exec.Command("umount", mountPoint)
-	output, err := cmd.CombinedOutput() // Capture both stdout and stderr
-	if err != nil {
-		return fmt.Errorf("failed to unmount %s: %v\nOutput: %s", mountPoint, err, output)
+	if err := cardMounter.Unmount(mountPoint); err != nil {
+		return fmt.Errorf("failed to unmount %s: %v", mountPoint, err)
 	}
 
-	logReceiver.Log("Successfully unmounted device %s", mountPoint)
+	logReceiver.WithDevice(sdCard.Name).Info("Successfully unmounted device %s", mountPoint)
 	return nil
 }
 
 // processSDCard handles the entire workflow for a given SD card device.
-func processSDCard(label string) {
-	// Ensure the device is not processed multiple times
-	if processedDevices[label] {
-		logReceiver.Log("Skipping already processed device: %s", label)
-		return
-	}
+// Progress is recorded in the job store so an interrupted ingest resumes at the stage it reached.
+// The device registry guarantees that a card is processed by one goroutine at a time.
+// The configuration it reads stays unchanged until it returns.
+func processSDCard(label string) error {
+	configs.enter()
+	defer configs.leave()
 
-	// Mark the device as being processed to prevent duplicate processing
-	processedDevices[label] = true
-	logReceiver.Log("Starting processing for device: %s", label)
+	logger := logReceiver.WithDevice(label)
+	logger.Info("Starting processing for device: %s", label)
 
-	sdCard, exists := sdCardMappings[label]
+	sdCard, exists := currentSettings().sdCardMappings[label]
 	if !exists {
-		logReceiver.Log("No configuration found for label: %s", label)
-		return
+		logger.Warn("No configuration found for label: %s", label)
+		return fmt.Errorf("no configuration found for label: %s", label)
+	}
+
+	job, resumed, err := jobStore.Begin(label)
+	if err != nil {
+		logger.Error("Error creating ingest job for %s: %v", label, err)
+		return fmt.Errorf("error creating ingest job for %s: %v", label, err)
+	}
+	devices.SetJob(label, job.ID)
+	logger = logReceiver.WithJob(job)
+	if resumed {
+		logger.Info("Resuming ingest job %s for %s at stage %s", job.ID, label, job.Stage)
+	}
+
+	if err := runIngest(sdCard, job); err != nil {
+		logger.Error("%v", err)
+		if err := jobStore.Fail(job, err); err != nil {
+			logger.Error("Error recording failure of job %s: %v", job.ID, err)
+		}
+		return err
+	}
+
+	logger.Info("Finished processing SD card: %s", label)
+	return nil
+}
+
+// runIngest runs the ingest stages for a card, skipping the stages the job has already passed.
+// The card is always (re)mounted since a resumed job usually follows a restart or re-insert.
+func runIngest(sdCard SDCard, job *IngestJob) error {
+	label := job.Label
+	logger := logReceiver.WithJob(job)
+
+	if err := enterStage(job, StageMount); err != nil {
+		return err
+	}
+
+	// Never copy into the archive root when the share is missing, the files would fill the local disk
+	if err := ensureDestination(); err != nil {
+		return fmt.Errorf("not importing %s, destination unavailable: %v", label, err)
 	}
 
 	// Check if the SD card is already mounted
 	mounted, err := isMounted(label)
 	if err != nil {
-		logReceiver.Log("%v", err)
-		return
+		return err
 	}
 
 	if !mounted {
-		// Attempt to mount the SD card
-		if err := mountDevice(label); err != nil {
-			logReceiver.Log("Error mounting device %s: %v", label, err)
-			return
+		// Attempt to mount the SD card that was identified as this mapping
+		device, exists := devices.Get(label)
+		if !exists || device.Block.Node == "" {
+			return fmt.Errorf("device %s is not connected", label)
+		}
+		if err := mountDevice(label, device.Block.Node); err != nil {
+			return fmt.Errorf("error mounting device %s: %v", label, err)
 		}
 
 		// Re-check if the device is mounted after attempting to mount
 		mounted, err = isMounted(label)
 		if err != nil || !mounted {
-			logReceiver.Log("Failed to verify mount status for device %s after mounting attempt", label)
-			return
+			return fmt.Errorf("failed to verify mount status for device %s after mounting attempt", label)
 		}
 	}
+	writeCardID(label)
 
 	// Copy files from the SD card to the destination
-	filesCopied, err := copyFiles(sdCard)
-	if err != nil {
-		logReceiver.Log("%v", err)
-		return
+	if !job.Passed(StageCopy) {
+		if err := enterStage(job, StageCopy); err != nil {
+			return err
+		}
+		// Refuse to start a copy that would fill the destination, a full share fails mid-file
+		if err := preflightSpace(sdCard, job); err != nil {
+			return err
+		}
+		if _, err := copyFiles(sdCard, job); err != nil {
+			return err
+		}
 	}
 
-	if filesCopied {
-		logReceiver.Log("Files were copied from %s, creating proxies...", label)
-		if err := createProxies(sdCard); err != nil {
-			logReceiver.Log("%v", err)
-			return
+	if len(job.CopiedFiles()) > 0 {
+		// Verify files exist before clearing the SD card
+		if !job.Passed(StageVerify) {
+			if err := enterStage(job, StageVerify); err != nil {
+				return err
+			}
+			settings := currentSettings()
+			for _, file := range job.CopiedFiles() {
+				if !file.Verified {
+					return fmt.Errorf("file %s was not verified at destination %s", filepath.Base(file.Source), file.Destination)
+				}
+				stored, err := settings.statOriginal(file.Destination)
+				if err != nil {
+					return fmt.Errorf("file %s not found at destination %s", filepath.Base(file.Source), settings.originalLocation(file.Destination))
+				}
+				if stored.Size != file.Size {
+					return fmt.Errorf("file %s at destination %s is %d bytes, expected %d", filepath.Base(file.Source), settings.originalLocation(file.Destination), stored.Size, file.Size)
+				}
+			}
 		}
 
-		// Verify files exist before clearing the SD card
-		for _, sourceDir := range sdCard.SourceDirs {
-			sdCardPath := filepath.Join("/media/videoserver", sdCard.Name, sourceDir)
-			files, err := os.ReadDir(sdCardPath)
-			if err != nil {
-				logReceiver.Log("Error reading directory %s: %v", sdCardPath, err)
-				continue
+		if !job.Passed(StageCatalog) {
+			if err := enterStage(job, StageCatalog); err != nil {
+				return err
 			}
+			catalogFiles(sdCard, job)
+		}
 
-			for _, file := range files {
-				if !file.IsDir() {
-					destinationFilePath := filepath.Join(sdCard.Destination, file.Name())
-					if !verifyFileExists(destinationFilePath) {
-						logReceiver.Log("File %s not found at destination %s", file.Name(), destinationFilePath)
-						return
-					}
+		if !job.Passed(StageProxy) {
+			if err := enterStage(job, StageProxy); err != nil {
+				return err
+			}
+			// Proxies render in the background so the card can be cleared and ejected right away
+			logger.Info("Files were copied from %s, queueing proxies...", label)
+			profiles := cardProxyProfiles(sdCard)
+			for _, file := range job.CopiedFiles() {
+				if err := queueProxies(file.Destination, profiles, PriorityIngest); err != nil {
+					return err
 				}
 			}
 		}
 
-		if err := clearSDCard(sdCard); err != nil {
-			logReceiver.Log("%v", err)
-			return
+		if !job.Passed(StageClear) {
+			if err := enterStage(job, StageClear); err != nil {
+				return err
+			}
+			if err := clearSDCard(sdCard, job); err != nil {
+				return err
+			}
 		}
 	} else {
-		logReceiver.Log("No files copied from %s. Skipping proxy creation and clearing.", label)
+		logger.Info("No files copied from %s. Skipping proxy creation and clearing.", label)
 	}
 
 	// Eject the SD card after processing
+	if err := enterStage(job, StageEject); err != nil {
+		return err
+	}
 	if err := ejectSDCard(sdCard); err != nil {
-		logReceiver.Log("%v", err)
-		return
+		return err
 	}
 
-	logReceiver.Log("Finished processing SD card: %s", label)
+	return enterStage(job, StageDone)
 }
 
-// Helper function to check if a slice contains a specific device label
-func contains(devices []string, label string) bool {
-	for _, device := range devices {
-		if device == label {
-			return true
-		}
+// enterStage records that the job is starting the given stage and moves the device to the matching state.
+// Earlier stages are never re-entered in the job, so a resumed job does not move backwards.
+func enterStage(job *IngestJob, stage JobStage) error {
+	if devices.Aborted(job.Label) {
+		return errIngestAborted
 	}
-	return false
+	if state, exists := stageStates[stage]; exists {
+		devices.Transition(job.Label, state) // Done and failed are recorded by devices.Finish
+	}
+	if stageIndex(job.Stage) >= stageIndex(stage) {
+		return nil
+	}
+	if err := jobStore.SetStage(job, stage); err != nil {
+		return fmt.Errorf("failed to record stage %s for job %s: %v", stage, job.ID, err)
+	}
+	return nil
 }
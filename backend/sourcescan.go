@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Folder structures for SDCard.Structure.
+const (
+	StructureFlatten  = "flatten"  // Copy every file into the destination folder (default)
+	StructurePreserve = "preserve" // Keep the folders below the fixed part of the source pattern, e.g. 100GOPRO/ for DCIM/*GOPRO
+)
+
+// sourceFile is a file on the card selected for import.
+type sourceFile struct {
+	Path         string // Absolute path on the mounted card
+	RelativePath string // Path below the fixed part of the source pattern, used to preserve the folder structure
+	Info         os.FileInfo
+}
+
+// structure returns the effective folder structure of the card.
+func (sdCard SDCard) structure() string {
+	if sdCard.Structure == "" {
+		return StructureFlatten
+	}
+	return sdCard.Structure
+}
+
+// validStructure reports whether structure is a known folder structure. An empty structure means the default.
+func validStructure(structure string) bool {
+	switch structure {
+	case "", StructureFlatten, StructurePreserve:
+		return true
+	}
+	return false
+}
+
+// globMatch reports whether a slash separated path matches a pattern. Elements are matched with path.Match,
+// "**" matches any number of folders. Matching ignores case since cards are FAT or exFAT formatted.
+func globMatch(pattern, name string) bool {
+	return matchElements(strings.Split(strings.ToLower(pattern), "/"), strings.Split(strings.ToLower(name), "/"))
+}
+
+// matchElements matches the path elements of a name against the elements of a pattern.
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if matched, err := path.Match(pattern[0], name[0]); err != nil || !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchesFilter reports whether a file matches a filter pattern. Patterns without a slash match the file name,
+// e.g. "*.LRV", others the path relative to the card root, e.g. "DCIM/**/*.MP4".
+func matchesFilter(pattern, relativePath string) bool {
+	if !strings.Contains(pattern, "/") {
+		return globMatch(pattern, path.Base(relativePath))
+	}
+	return globMatch(pattern, relativePath)
+}
+
+// matchesAnyFilter reports whether a file matches one of the filter patterns.
+func matchesAnyFilter(patterns []string, relativePath string) bool {
+	for _, pattern := range patterns {
+		if matchesFilter(pattern, relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionPatterns turns a list of extensions such as ".LRV" into exclude patterns such as "*.LRV".
+func extensionPatterns(extensions []string) []string {
+	patterns := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		patterns = append(patterns, "*"+ext)
+	}
+	return patterns
+}
+
+// excludePatterns returns the exclude rules of the card: its own, the ignored extensions of its camera profile
+// and the globally ignored extensions.
+func (sdCard SDCard) excludePatterns() []string {
+	patterns := append([]string{}, sdCard.Exclude...)
+	patterns = append(patterns, extensionPatterns(sdCard.camera().IgnoredExtensions)...)
+	return append(patterns, extensionPatterns(currentSettings().ignoredExtensions)...)
+}
+
+// selectsFile reports whether a file on the card, relative to its root, is imported.
+// Files must match one of the include patterns, if there are any, and none of the exclude patterns.
+func (sdCard SDCard) selectsFile(relativePath string) bool {
+	if len(sdCard.Include) > 0 && !matchesAnyFilter(sdCard.Include, relativePath) {
+		return false
+	}
+	return !matchesAnyFilter(sdCard.excludePatterns(), relativePath)
+}
+
+// isCardMetadata reports whether a path relative to the card root belongs to the processor rather than the camera.
+func isCardMetadata(relativePath string) bool {
+	first := strings.Split(relativePath, "/")[0]
+	return first == quarantineDir || first == cardIDFile
+}
+
+// fixedPrefix returns the leading elements of a source pattern that contain no glob characters.
+func fixedPrefix(pattern string) string {
+	var prefix []string
+	for _, element := range strings.Split(pattern, "/") {
+		if strings.ContainsAny(element, "*?[") {
+			break
+		}
+		prefix = append(prefix, element)
+	}
+	return path.Join(prefix...)
+}
+
+// matchSourceDirs returns the folders of the card matching a source pattern, relative to the card root.
+// A pattern without glob characters is a single folder, as source directories always were.
+func matchSourceDirs(cardRoot, pattern string) ([]string, error) {
+	pattern = path.Clean(pattern)
+	base := fixedPrefix(pattern)
+	if base == pattern {
+		return []string{pattern}, nil
+	}
+
+	var dirs []string
+	baseDir := filepath.Join(cardRoot, filepath.FromSlash(base))
+	err := filepath.WalkDir(baseDir, func(dirPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if dirPath == baseDir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(cardRoot, dirPath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+		if isCardMetadata(relativePath) {
+			return filepath.SkipDir
+		}
+		if globMatch(pattern, relativePath) {
+			dirs = append(dirs, relativePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", pattern, err)
+	}
+	return dirs, nil
+}
+
+// scanSourceFiles lists the files of the card to import: the files directly in every folder matching
+// one of its source patterns that pass its include and exclude rules, without duplicates.
+func scanSourceFiles(sdCard SDCard, cardRoot string) ([]sourceFile, error) {
+	logger := logReceiver.WithDevice(sdCard.Name)
+	seen := make(map[string]bool)
+	var files []sourceFile
+	for _, pattern := range sdCard.sourceDirs() {
+		dirs, err := matchSourceDirs(cardRoot, pattern)
+		if err != nil {
+			return nil, err
+		}
+		base := fixedPrefix(path.Clean(pattern))
+
+		for _, dir := range dirs {
+			dirPath := filepath.Join(cardRoot, filepath.FromSlash(dir))
+			entries, err := os.ReadDir(dirPath)
+			if os.IsNotExist(err) {
+				logger.Warn("Source directory does not exist: %s", dirPath)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read directory %s: %v", dirPath, err)
+			}
+			logger.WithField("count", len(entries)).Debug("Files found in %s: %v", dirPath, entries)
+
+			for _, entry := range entries {
+				relativePath := path.Join(dir, entry.Name())
+				if entry.IsDir() || isCardMetadata(relativePath) || seen[relativePath] {
+					continue
+				}
+				if !sdCard.selectsFile(relativePath) {
+					logger.WithFile(relativePath).Debug("Ignoring file: %s", relativePath)
+					continue
+				}
+				info, err := entry.Info()
+				if err != nil {
+					return nil, fmt.Errorf("failed to stat file %s: %v", relativePath, err)
+				}
+				seen[relativePath] = true
+
+				belowBase := relativePath
+				if base != "" {
+					belowBase = strings.TrimPrefix(relativePath, base+"/")
+				}
+				files = append(files, sourceFile{
+					Path:         filepath.Join(cardRoot, filepath.FromSlash(relativePath)),
+					RelativePath: belowBase,
+					Info:         info,
+				})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// validateSourcePatterns checks the source, include and exclude patterns and the folder structure of a card.
+func validateSourcePatterns(label string, sdCard SDCard) error {
+	if !validStructure(sdCard.Structure) {
+		return fmt.Errorf("invalid structure %q for %s, expected %s or %s", sdCard.Structure, label, StructureFlatten, StructurePreserve)
+	}
+	patterns := append(append(append([]string{}, sdCard.SourceDirs...), sdCard.Include...), sdCard.Exclude...)
+	for _, pattern := range patterns {
+		if pattern == "" || path.IsAbs(pattern) || strings.HasPrefix(path.Clean(pattern), "..") {
+			return fmt.Errorf("pattern %q for %s must be relative to the card root", pattern, label)
+		}
+		for _, element := range strings.Split(pattern, "/") {
+			if _, err := path.Match(element, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q for %s: %v", pattern, label, err)
+			}
+		}
+	}
+	return nil
+}
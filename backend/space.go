@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Free space policies for SpaceConfig.Policy.
+const (
+	SpaceRefuse = "refuse" // Do not start copying a card that would eat into the reserve (default)
+	SpaceWarn   = "warn"   // Log a warning and copy anyway
+)
+
+const (
+	defaultReserveGB  = 10
+	defaultProxyRatio = 0.1 // A 720p H.264 proxy is roughly a tenth of a 4K original
+)
+
+// SpaceConfig controls the free space check that runs before a card is copied.
+type SpaceConfig struct {
+	ReserveGB  float64 `json:"reserveGB,omitempty"`  // Space kept free on every destination, defaults to 10
+	Policy     string  `json:"policy,omitempty"`     // "refuse" (default) or "warn"
+	ProxyRatio float64 `json:"proxyRatio,omitempty"` // Expected size of one proxy relative to its original, defaults to 0.1
+}
+
+// VolumeUsage is the capacity of a filesystem that footage is written to.
+type VolumeUsage struct {
+	Name         string `json:"name"` // "archive" or the name of a backup destination
+	Path         string `json:"path"`
+	TotalBytes   uint64 `json:"totalBytes"`
+	FreeBytes    uint64 `json:"freeBytes"` // Available to the processor, excluding blocks reserved for root
+	ReserveBytes uint64 `json:"reserveBytes"`
+	Error        string `json:"error,omitempty"`
+
+	device uint64 // Device of the filesystem, shared by roots on the same disk or share
+}
+
+// policy returns the effective free space policy.
+func (c SpaceConfig) policy() string {
+	if c.Policy == "" {
+		return SpaceRefuse
+	}
+	return c.Policy
+}
+
+// reserveBytes returns the space kept free on every destination.
+func (c SpaceConfig) reserveBytes() uint64 {
+	if c.ReserveGB == 0 {
+		return defaultReserveGB << 30
+	}
+	return uint64(c.ReserveGB * (1 << 30))
+}
+
+// proxyRatio returns the expected size of one proxy relative to its original.
+func (c SpaceConfig) proxyRatio() float64 {
+	if c.ProxyRatio == 0 {
+		return defaultProxyRatio
+	}
+	return c.ProxyRatio
+}
+
+// validateSpace checks the free space settings.
+func validateSpace(c SpaceConfig) error {
+	switch c.Policy {
+	case "", SpaceRefuse, SpaceWarn:
+	default:
+		return fmt.Errorf("invalid free space policy: %s", c.Policy)
+	}
+	if c.ReserveGB < 0 || c.ProxyRatio < 0 {
+		return fmt.Errorf("free space reserve and proxy ratio cannot be negative")
+	}
+	return nil
+}
+
+// statVolume returns the capacity of the filesystem holding path. Folders that do not exist yet are checked
+// on the nearest existing parent, and a filesystem that does not answer is reported as an error.
+func statVolume(name, path string, reserve uint64) VolumeUsage {
+	usage := VolumeUsage{Name: name, Path: path, ReserveBytes: reserve}
+	var stat syscall.Statfs_t
+	var device uint64
+	err := callWithTimeout(path, func() error {
+		existing := path
+		for {
+			if _, err := os.Stat(existing); err == nil || filepath.Dir(existing) == existing {
+				break
+			}
+			existing = filepath.Dir(existing)
+		}
+		info, err := os.Stat(existing)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", existing, err)
+		}
+		if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+			device = uint64(sys.Dev)
+		}
+		if err := syscall.Statfs(existing, &stat); err != nil {
+			return fmt.Errorf("failed to stat %s: %v", existing, err)
+		}
+		return nil
+	})
+	if err != nil {
+		usage.Error = err.Error()
+		return usage
+	}
+	usage.device = device
+	usage.TotalBytes = stat.Blocks * uint64(stat.Bsize)
+	usage.FreeBytes = stat.Bavail * uint64(stat.Bsize)
+	return usage
+}
+
+// storageVolumes returns the filesystems footage is written to: the archive, which always holds the proxies,
+// the root of the originals when they are files stored elsewhere, and the roots of the local backup destinations of every card.
+func storageVolumes() []VolumeUsage {
+	settings := currentSettings()
+	reserve := settings.spaceConfig.reserveBytes()
+	volumes := []VolumeUsage{statVolume("archive", settings.paths.ArchiveRoot, reserve)}
+	seen := map[string]bool{settings.paths.ArchiveRoot: true}
+	if local, ok := settings.originals.(*localStorage); ok && !seen[local.root] {
+		seen[local.root] = true
+		volumes = append(volumes, statVolume("originals", local.root, reserve))
+	}
+	for _, sdCard := range settings.sdCardMappings {
+		for _, backup := range sdCard.Backups {
+			if backup.Root == "" || seen[backup.Root] {
+				continue
+			}
+			seen[backup.Root] = true
+			volumes = append(volumes, statVolume(backup.Name, backup.Root, reserve))
+		}
+	}
+	sort.SliceStable(volumes[1:], func(i, j int) bool { return volumes[1+i].Name < volumes[1+j].Name })
+	return volumes
+}
+
+// formatBytes formats a byte count with a binary unit for log messages.
+func formatBytes(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value, unit := float64(bytes), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// preflightSpace checks that the files left to copy from the card, and their proxies, fit on every destination
+// without eating into the reserve. Destinations on the same filesystem share its free space, and files that are
+// already archived and would be reused instead of copied are not counted. Depending on the policy a shortage
+// refuses the import or is logged as a warning. Destinations whose capacity is unknown, such as buckets, are not checked.
+func preflightSpace(sdCard SDCard, job *IngestJob) error {
+	logger := logReceiver.WithJob(job)
+	settings := currentSettings()
+	files, err := scanSourceFiles(sdCard, settings.paths.cardMountPoint(sdCard.Name))
+	if err != nil {
+		return err
+	}
+
+	var pending uint64
+	for _, file := range files {
+		if progress, exists := job.Files[file.Path]; exists && progress.Verified && progress.Size == file.Info.Size() {
+			continue // Copied by an earlier run of this job
+		}
+		if sdCard.collisionStrategy() == CollisionSkipIdentical && plannedDestination(job, file.Path, file.Info) == "" {
+			destinationDir, _ := sdCard.archiveDir(file)
+			name := sdCard.importName(filepath.Base(file.Path))
+			if _, digest, err := identicalOriginal(file.Path, destinationDir, name, file.Info); err != nil {
+				return err
+			} else if digest != "" {
+				continue // Archived by an earlier import, copyFiles reuses it
+			}
+		}
+		pending += uint64(file.Info.Size())
+	}
+	if pending == 0 {
+		return nil
+	}
+	proxies := uint64(float64(pending) * settings.spaceConfig.proxyRatio() * float64(len(cardProxyProfiles(sdCard))))
+
+	// Proxies always live below the archive root, originals only when they are stored as files
+	needed := map[string]uint64{settings.paths.ArchiveRoot: proxies}
+	names := map[string]string{settings.paths.ArchiveRoot: "archive"}
+	if local, ok := settings.originals.(*localStorage); ok {
+		needed[local.root] += pending
+		if names[local.root] == "" {
+			names[local.root] = "originals"
+		}
+	}
+	for _, backup := range sdCard.Backups {
+		if backup.Root != "" {
+			needed[backup.Root] += pending
+			names[backup.Root] = backup.Name
+		}
+	}
+
+	// Sum what goes to each filesystem, several roots may be folders of the same disk or share
+	type volumeNeed struct {
+		usage VolumeUsage
+		roots []string
+		bytes uint64
+	}
+	volumes := make(map[uint64]*volumeNeed)
+	for root, bytes := range needed {
+		usage := statVolume(names[root], root, settings.spaceConfig.reserveBytes())
+		if usage.Error != "" {
+			return fmt.Errorf("failed to check free space on %s: %s", root, usage.Error)
+		}
+		volume := volumes[usage.device]
+		if volume == nil {
+			volume = &volumeNeed{usage: usage}
+			volumes[usage.device] = volume
+		}
+		volume.roots = append(volume.roots, root)
+		volume.bytes += bytes
+	}
+
+	var shortages []string
+	for _, volume := range volumes {
+		if volume.usage.FreeBytes < volume.bytes+volume.usage.ReserveBytes {
+			sort.Strings(volume.roots)
+			shortages = append(shortages, fmt.Sprintf("%s needs %s but has %s free with a reserve of %s",
+				strings.Join(volume.roots, " and "), formatBytes(volume.bytes), formatBytes(volume.usage.FreeBytes), formatBytes(volume.usage.ReserveBytes)))
+		}
+	}
+	sort.Strings(shortages)
+
+	logger.WithField("bytes", pending).Info("Preflight for %s: %s to copy, about %s of proxies", sdCard.Name, formatBytes(pending), formatBytes(proxies))
+	for _, shortage := range shortages {
+		if settings.spaceConfig.policy() == SpaceRefuse {
+			return fmt.Errorf("not importing %s, not enough space: %s", sdCard.Name, shortage)
+		}
+		logger.Warn("Low on space importing %s: %s", sdCard.Name, shortage)
+	}
+	return nil
+}
+
+// HandleStorage handles GET /api/storage with the capacity of every destination footage is written to.
+func HandleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storageVolumes())
+}
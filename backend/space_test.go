@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStorageVolumes(t *testing.T) {
+	root := useTestArchive(t)
+	originalsRoot := filepath.Join(t.TempDir(), "originals")
+	useTestSettings(t, func(settings *Settings) {
+		settings.originals = &localStorage{root: originalsRoot}
+		settings.sdCardMappings = map[string]SDCard{
+			"GOPRO": {Name: "GOPRO", Backups: []BackupDestination{{Name: "offsite", StorageConfig: StorageConfig{Root: filepath.Join(t.TempDir(), "offsite")}}}},
+		}
+	})
+
+	volumes := storageVolumes()
+	var names []string
+	for _, volume := range volumes {
+		names = append(names, volume.Name)
+		if volume.Error != "" || volume.TotalBytes == 0 {
+			t.Errorf("volume %s: %+v", volume.Name, volume)
+		}
+	}
+	if len(volumes) != 3 || volumes[0].Path != root || names[1] != "offsite" || names[2] != "originals" {
+		t.Fatalf("volumes %v", names)
+	}
+
+	// Originals stored below the archive root are not listed twice
+	useTestSettings(t, func(settings *Settings) { settings.originals = &localStorage{root: root} })
+	if volumes := storageVolumes(); len(volumes) != 2 {
+		t.Fatalf("got %d volumes, want 2", len(volumes))
+	}
+}
+
+// useTestCard points the card mount root at a temporary folder and returns the mount point of the card.
+func useTestCard(t *testing.T, sdCard SDCard) string {
+	t.Helper()
+	cardMountRoot := t.TempDir()
+	useTestSettings(t, func(settings *Settings) { settings.paths.CardMountRoot = cardMountRoot })
+	return currentSettings().paths.cardMountPoint(sdCard.Name)
+}
+
+func TestPreflightSpaceSumsDestinationsOnOneFilesystem(t *testing.T) {
+	root := useTestArchive(t)
+	sdCard := SDCard{Name: "GOPRO", Profile: "gopro", Destination: "{card}",
+		Backups: []BackupDestination{{Name: "second-disk", StorageConfig: StorageConfig{Root: t.TempDir()}}}}
+	cardRoot := useTestCard(t, sdCard)
+
+	// A sparse clip takes no space on the test disk
+	clip := filepath.Join(cardRoot, "DCIM", "100GOPRO", "GX010001.MP4")
+	writeTestFile(t, clip, "")
+	if err := os.Truncate(clip, 1<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave room for one copy of the clip but not for the archive and the backup on the same disk
+	usage := statVolume("archive", root, 0)
+	if usage.Error != "" || usage.FreeBytes < 2<<30 {
+		t.Skipf("not enough free space to run the test: %+v", usage)
+	}
+	reserve := usage.FreeBytes - 3<<29
+	useTestSettings(t, func(settings *Settings) {
+		settings.spaceConfig = SpaceConfig{ReserveGB: float64(reserve) / (1 << 30), Policy: SpaceRefuse}
+	})
+
+	job := &IngestJob{ID: "test", Label: sdCard.Name, Files: make(map[string]*FileProgress)}
+	if err := preflightSpace(sdCard, job); err == nil {
+		t.Fatal("import started although the archive and the backup on one disk do not fit")
+	}
+	sdCard.Backups = nil
+	if err := preflightSpace(sdCard, job); err != nil {
+		t.Fatalf("import refused for one copy that fits: %v", err)
+	}
+}
+
+func TestPreflightSpaceSkipsArchivedFiles(t *testing.T) {
+	root := useTestArchive(t)
+	sdCard := SDCard{Name: "GOPRO", Profile: "gopro", Destination: "{card}"}
+	cardRoot := useTestCard(t, sdCard)
+	useTestSettings(t, func(settings *Settings) {
+		settings.spaceConfig = SpaceConfig{ReserveGB: 1 << 30, Policy: SpaceRefuse} // No file fits
+	})
+
+	// The clip was archived by an earlier import of the card, which did not clear it
+	writeTestFile(t, filepath.Join(cardRoot, "DCIM", "100GOPRO", "GX010001.MP4"), "first clip")
+	writeTestFile(t, filepath.Join(root, "GOPRO", "GX010001.MP4"), "first clip")
+	job := &IngestJob{ID: "test", Label: sdCard.Name, Files: make(map[string]*FileProgress)}
+	if err := preflightSpace(sdCard, job); err != nil {
+		t.Fatalf("import refused for a card that only holds archived files: %v", err)
+	}
+
+	writeTestFile(t, filepath.Join(cardRoot, "DCIM", "100GOPRO", "GX010002.MP4"), "second clip")
+	if err := preflightSpace(sdCard, job); err == nil {
+		t.Fatal("import started although the new clip does not fit")
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage types for StorageConfig.Type.
+//
+// SMB is not a storage type of its own: Go has no SMB client in its standard library, and the processor already
+// relies on kernel mounts for NFS. Mount the share with cifs and point the archive root at it instead.
+const (
+	StorageLocal = "local" // Originals are files below the archive root, which may be a mounted NFS or SMB share (default)
+	StorageS3    = "s3"    // Originals are objects in an S3-compatible bucket
+)
+
+// StorageConfig selects where original footage is archived. The manifests are stored next to the originals,
+// proxies always stay below the archive root.
+type StorageConfig struct {
+	Type      string `json:"type,omitempty"`     // "local" (default) or "s3"
+	Root      string `json:"root,omitempty"`     // Folder the local type stores originals below, defaults to the archive root
+	Endpoint  string `json:"endpoint,omitempty"` // e.g. "https://s3.eu-central-1.amazonaws.com" or "http://minio:9000"
+	Region    string `json:"region,omitempty"`   // Defaults to "us-east-1", which MinIO accepts
+	Bucket    string `json:"bucket,omitempty"`   //
+	Prefix    string `json:"prefix,omitempty"`   // Prepended to every key, e.g. "video_archive/"
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"` // Address the bucket as endpoint/bucket instead of bucket.endpoint, needed for MinIO
+}
+
+// StorageObject describes a stored original.
+type StorageObject struct {
+	Name    string    `json:"name"` // Slash separated key relative to the archive root
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Storage is where original footage is archived. Names are slash separated paths relative to the archive root,
+// so an original keeps the same name whichever storage holds it. Missing objects are reported with os.ErrNotExist.
+type Storage interface {
+	// Put stores size bytes from src under name and verifies what was stored, returning its hex encoded SHA-256 digest.
+	// The object only becomes visible once it is complete.
+	Put(name string, src io.Reader, size int64) (string, error)
+	Stat(name string) (StorageObject, error)
+	// List returns the objects whose name starts with prefix, sorted by name.
+	List(prefix string) ([]StorageObject, error)
+	Move(from, to string) error
+	Delete(name string) error
+	// OpenRange reads length bytes from offset. A negative length reads to the end.
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+	// Location describes where an object is stored, e.g. a file path or an s3:// URL, for logs and job records.
+	Location(name string) string
+}
+
+// presigner is implemented by storages whose objects ffmpeg and ffprobe can read from a URL.
+type presigner interface {
+	PresignGet(name string, expiry time.Duration) (string, error)
+}
+
+// newStorage creates the storage for originals described by the configuration.
+// Local originals are kept below archiveRoot.
+func newStorage(config StorageConfig, archiveRoot string) (Storage, error) {
+	switch config.Type {
+	case "", StorageLocal:
+		if config.Root != "" {
+			return &localStorage{root: config.Root}, nil
+		}
+		return &localStorage{root: archiveRoot}, nil
+	case StorageS3:
+		return newS3Storage(config)
+	}
+	return nil, fmt.Errorf("invalid storage type: %s", config.Type)
+}
+
+// validateStorage checks the storage configuration.
+func validateStorage(config StorageConfig) error {
+	if config.Root != "" && !filepath.IsAbs(config.Root) {
+		return fmt.Errorf("storage root must be an absolute path: %s", config.Root)
+	}
+	if config.Type != StorageS3 {
+		_, err := newStorage(config, defaultArchiveRoot)
+		return err
+	}
+	if config.Endpoint == "" || config.Bucket == "" {
+		return fmt.Errorf("s3 storage needs an endpoint and a bucket")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return fmt.Errorf("s3 storage needs an access key and a secret key")
+	}
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return fmt.Errorf("s3 endpoint must start with http:// or https://: %s", config.Endpoint)
+	}
+	return nil
+}
+
+// archiveKey returns the storage name of an original at the given path below the archive root.
+func (s *Settings) archiveKey(originalPath string) (string, error) {
+	relativePath, err := filepath.Rel(s.paths.ArchiveRoot, originalPath)
+	if err != nil || relativePath == "." || strings.HasPrefix(relativePath, "..") {
+		return "", fmt.Errorf("%s is not inside the archive root %s", originalPath, s.paths.ArchiveRoot)
+	}
+	return filepath.ToSlash(relativePath), nil
+}
+
+// archivePathOf returns the path below the archive root that an original with the given storage name is known by.
+func (s *Settings) archivePathOf(name string) string {
+	return filepath.Join(s.paths.ArchiveRoot, filepath.FromSlash(name))
+}
+
+// statOriginal returns the stored original at the given path.
+func (s *Settings) statOriginal(originalPath string) (StorageObject, error) {
+	key, err := s.archiveKey(originalPath)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	return s.originals.Stat(key)
+}
+
+// originalExists reports whether an original is stored at the given path.
+func (s *Settings) originalExists(originalPath string) bool {
+	_, err := s.statOriginal(originalPath)
+	return err == nil
+}
+
+// listOriginals returns the originals stored below a folder of the archive, leaving out the manifests.
+func (s *Settings) listOriginals(dir string) ([]StorageObject, error) {
+	prefix, err := s.archiveKey(dir)
+	if err != nil {
+		prefix = "" // The archive root itself
+		if filepath.Clean(dir) != filepath.Clean(s.paths.ArchiveRoot) {
+			return nil, err
+		}
+	} else {
+		prefix += "/"
+	}
+	objects, err := s.originals.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	footage := objects[:0]
+	for _, object := range objects {
+		if !isArchiveMetadata(path.Base(object.Name)) {
+			footage = append(footage, object)
+		}
+	}
+	return footage, nil
+}
+
+// originalLocation describes where the original with the given archive path is stored.
+func (s *Settings) originalLocation(originalPath string) string {
+	key, err := s.archiveKey(originalPath)
+	if err != nil {
+		return originalPath
+	}
+	return s.originals.Location(key)
+}
+
+// localOriginalPath returns the file holding the original with the given archive path when the storage
+// keeps originals on disk. Its root is not necessarily the archive root.
+func (s *Settings) localOriginalPath(originalPath string) (string, bool) {
+	local, ok := s.originals.(*localStorage)
+	if !ok {
+		return "", false
+	}
+	key, err := s.archiveKey(originalPath)
+	if err != nil {
+		return "", false
+	}
+	return local.path(key), true
+}
+
+// storeOriginal copies a file from the card to the storage under the name of its archive path.
+// onProgress, if not nil, is called with the number of bytes copied so far. The copy stops with the cause
+// of ctx when ctx is cancelled, so aborting an ingest does not wait for a large file.
+// It returns the hex encoded SHA-256 digest of the stored original.
+func storeOriginal(ctx context.Context, sourcePath, originalPath string, size int64, onProgress func(written int64)) (string, error) {
+	settings := currentSettings()
+	key, err := settings.archiveKey(originalPath)
+	if err != nil {
+		return "", err
+	}
+	return storeFile(ctx, settings.originals, sourcePath, key, size, onProgress)
+}
+
+// storeFile copies a file from the card to a storage under the given name and returns the digest of what was stored.
+func storeFile(ctx context.Context, storage Storage, sourcePath, name string, size int64, onProgress func(written int64)) (string, error) {
+	in, err := os.Open(sourcePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", sourcePath, err)
+	}
+	defer in.Close()
+
+	digest, err := storage.Put(name, &contextReader{ctx: ctx, r: io.TeeReader(in, &progressWriter{onProgress: onProgress})}, size)
+	if ctx.Err() != nil {
+		return "", context.Cause(ctx)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to store %s at %s: %v", sourcePath, storage.Location(name), err)
+	}
+	return digest, nil
+}
+
+// mediaSource returns what ffmpeg and ffprobe should read for an original: its file when the storage keeps
+// originals on disk, otherwise a short-lived URL when the storage supports it.
+func mediaSource(originalPath string) string {
+	settings := currentSettings()
+	if localPath, ok := settings.localOriginalPath(originalPath); ok {
+		return localPath
+	}
+	if signer, ok := settings.originals.(presigner); ok {
+		if key, err := settings.archiveKey(originalPath); err == nil {
+			if url, err := signer.PresignGet(key, 6*time.Hour); err == nil {
+				return url
+			}
+		}
+	}
+	return originalPath
+}
+
+// localStorage keeps originals as files below a root directory.
+type localStorage struct {
+	root string
+}
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *localStorage) Put(name string, src io.Reader, size int64) (string, error) {
+	dst := s.path(name)
+	digest, written, err := writeFileVerified(dst, src)
+	if err != nil {
+		return "", err
+	}
+	if written != size {
+		os.Remove(dst)
+		return "", fmt.Errorf("short copy to %s: %d of %d bytes", dst, written, size)
+	}
+	return digest, nil
+}
+
+func (s *localStorage) Stat(name string) (StorageObject, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return StorageObject{}, err
+	}
+	if info.IsDir() {
+		return StorageObject{}, os.ErrNotExist
+	}
+	return StorageObject{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the folders below prefix, skipping proxy folders, hidden folders and archive metadata.
+func (s *localStorage) List(prefix string) ([]StorageObject, error) {
+	dir := s.path(prefix)
+	if !strings.HasSuffix(prefix, "/") && prefix != "" {
+		dir = filepath.Dir(dir)
+	}
+	var objects []StorageObject
+	err := walkMediaDirs(dir, func(dir string) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || isArchiveMetadata(entry.Name()) {
+				continue
+			}
+			relativePath, err := filepath.Rel(s.root, filepath.Join(dir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			name := filepath.ToSlash(relativePath)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				objects = append(objects, StorageObject{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// Move renames the file, creating the target folder which may be missing when the root is not the archive root.
+func (s *localStorage) Move(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(to)), 0777); err != nil { // Explicitly set permissions to 0777
+		return err
+	}
+	return os.Rename(s.path(from), s.path(to))
+}
+
+func (s *localStorage) Delete(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *localStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (s *localStorage) Location(name string) string {
+	return s.path(name)
+}
+
+// memoryStorage keeps originals in memory. It is the in-process fake tests exercise the pipeline with,
+// and deliberately not a storage type of the configuration: a copy that is gone after a restart must never
+// count towards clearing a card.
+type memoryStorage struct {
+	mu      sync.Mutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{objects: make(map[string]memoryObject)}
+}
+
+func (s *memoryStorage) Put(name string, src io.Reader, size int64) (string, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	if int64(len(data)) != size {
+		return "", fmt.Errorf("short copy to %s: %d of %d bytes", name, len(data), size)
+	}
+	digest := sha256.Sum256(data)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = memoryObject{data: data, modTime: time.Now()}
+	return hex.EncodeToString(digest[:]), nil
+}
+
+func (s *memoryStorage) Stat(name string) (StorageObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, exists := s.objects[name]
+	if !exists {
+		return StorageObject{}, os.ErrNotExist
+	}
+	return StorageObject{Name: name, Size: int64(len(object.data)), ModTime: object.modTime}, nil
+}
+
+func (s *memoryStorage) List(prefix string) ([]StorageObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var objects []StorageObject
+	for name, object := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, StorageObject{Name: name, Size: int64(len(object.data)), ModTime: object.modTime})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (s *memoryStorage) Move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, exists := s.objects[from]
+	if !exists {
+		return os.ErrNotExist
+	}
+	delete(s.objects, from)
+	s.objects[to] = object
+	return nil
+}
+
+func (s *memoryStorage) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.objects[name]; !exists {
+		return os.ErrNotExist
+	}
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memoryStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	object, exists := s.objects[name]
+	s.mu.Unlock()
+	if !exists {
+		return nil, os.ErrNotExist
+	}
+	if offset > int64(len(object.data)) {
+		offset = int64(len(object.data))
+	}
+	end := int64(len(object.data))
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	return io.NopCloser(bytes.NewReader(object.data[offset:end])), nil
+}
+
+func (s *memoryStorage) Location(name string) string {
+	return "memory:" + name
+}
+
+// ServeOriginal handles GET /api/original?path=..., streaming an original from the storage.
+// A single byte range is supported so players can seek.
+func ServeOriginal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	settings := currentSettings()
+	key, err := settings.archiveKey(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	object, err := settings.originals.Stat(key)
+	if os.IsNotExist(err) {
+		http.Error(w, "Original not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	offset, length := int64(0), object.Size
+	status := http.StatusOK
+	if header := r.Header.Get("Range"); header != "" {
+		start, end, ok := parseByteRange(header, object.Size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", object.Size))
+			http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		offset, length = start, end-start+1
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, object.Size))
+	}
+
+	reader, err := settings.originals.OpenRange(key, offset, length)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", path.Base(key)))
+	w.WriteHeader(status)
+	io.Copy(w, reader)
+}
+
+// parseByteRange parses a single "bytes=start-end" range, including open and suffix ranges, into inclusive offsets.
+func parseByteRange(header string, size int64) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
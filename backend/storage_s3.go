@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Objects up to s3PartSize are uploaded with a single PUT, larger ones as a multipart upload of parts that size.
+// Every part is buffered so its SHA-256 and MD5 can be sent ahead, letting the server reject corrupted uploads.
+const (
+	s3PartSize       = 64 << 20
+	s3MaxCopySize    = 5 << 30 // Largest object CopyObject accepts, larger ones are copied part by part
+	s3CopyPartSize   = 512 << 20
+	s3DefaultRegion  = "us-east-1"
+	s3EmptyHash      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // SHA-256 of an empty payload
+	s3SigningService = "s3"
+)
+
+// s3IdleTimeout is how long a request may go without sending or receiving data before it is given up, so an
+// unreachable endpoint fails the ingest instead of hanging it. Transfers of large originals may take as long
+// as they need while data keeps moving.
+var s3IdleTimeout = 2 * time.Minute
+
+// s3Storage keeps originals in an S3-compatible bucket, signing requests with AWS Signature Version 4.
+type s3Storage struct {
+	config   StorageConfig
+	endpoint *url.URL
+	client   *http.Client
+	partSize int64 // s3PartSize, smaller in tests to exercise multipart uploads
+}
+
+// newS3Storage creates the storage for the bucket described by the configuration.
+func newS3Storage(config StorageConfig) (*s3Storage, error) {
+	if err := validateStorage(config); err != nil {
+		return nil, err
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint %s: %v", config.Endpoint, err)
+	}
+	if config.Region == "" {
+		config.Region = s3DefaultRegion
+	}
+	return &s3Storage{config: config, endpoint: endpoint, client: newS3Client(), partSize: s3PartSize}, nil
+}
+
+// newS3Client returns the HTTP client for a bucket. It bounds connecting to the endpoint, do bounds the transfers.
+func newS3Client() *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+}
+
+// idleTimeoutReader postpones the cancellation of a request every time data is read from or for it.
+type idleTimeoutReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(s3IdleTimeout)
+	return n, err
+}
+
+// idleTimeoutBody is a response body that stops the request's timer once it is closed.
+type idleTimeoutBody struct {
+	idleTimeoutReader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, as Signature Version 4 requires.
+func s3Escape(value string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			escaped.WriteByte(b)
+		case b == '/' && keepSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// objectURL returns the URL of an object, or of the bucket for an empty key.
+func (s *s3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// canonicalQuery encodes query parameters sorted by key, as they are both sent and signed.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signature computes the Signature Version 4 signature of a canonical request.
+func (s *s3Storage) signature(canonicalRequest, amzDate string) (string, string) {
+	day := amzDate[:8]
+	scope := day + "/" + s.config.Region + "/" + s3SigningService + "/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), day)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, s3SigningService)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign)), scope
+}
+
+// sign adds the Authorization header to a request. The host and every x-amz- header are signed.
+func (s *s3Storage) sign(req *http.Request, payloadHash string) {
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	signature, scope := s.signature(canonicalRequest, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// PresignGet returns a URL that reads the object without credentials until it expires.
+func (s *s3Storage) PresignGet(name string, expiry time.Duration) (string, error) {
+	amzDate := time.Now().UTC().Format("20060102T150405Z")
+	_, scope := s.signature("", amzDate)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.config.AccessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u := s.objectURL(s.config.Prefix+name, query)
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet, u.EscapedPath(), u.RawQuery, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	signature, _ := s.signature(canonicalRequest, amzDate)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// s3Error is the error document S3 returns, sometimes with a 200 status for copies and completed uploads.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// do sends a signed request for an object and returns the response of a successful request.
+// A missing object is reported as os.ErrNotExist.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	// The request is cancelled once no data moved for s3IdleTimeout, until the response body is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(s3IdleTimeout, cancel)
+	stop := func() {
+		timer.Stop()
+		cancel()
+	}
+
+	u := s.objectURL(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	req.URL = u
+	if len(body) > 0 {
+		req.Body = io.NopCloser(&idleTimeoutReader{r: bytes.NewReader(body), timer: timer})
+		req.ContentLength = int64(len(body))
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := s3EmptyHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		stop()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("s3 %s %s failed: no response for %v", method, key, s3IdleTimeout)
+		}
+		return nil, fmt.Errorf("s3 %s %s failed: %v", method, key, err)
+	}
+	resp.Body = &idleTimeoutBody{idleTimeoutReader: idleTimeoutReader{r: resp.Body, timer: timer}, body: resp.Body, cancel: cancel}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3Err s3Error
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("s3 %s %s failed: %s: %s", method, key, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("s3 %s %s failed: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// doXML sends a request and decodes the XML response into result, failing on an embedded error document.
+func (s *s3Storage) doXML(method, key string, query url.Values, header http.Header, body []byte, result interface{}) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("s3 %s %s failed: %v", method, key, err)
+	}
+	var s3Err s3Error
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3 %s %s failed: %s: %s", method, key, s3Err.Code, s3Err.Message)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to decode s3 response for %s: %v", key, err)
+	}
+	return nil
+}
+
+// putPart uploads one buffered part, or the whole object when query is nil, and checks the returned ETag.
+func (s *s3Storage) putPart(key string, query url.Values, data []byte) (string, error) {
+	sum := md5.Sum(data)
+	header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+	resp, err := s.do(http.MethodPut, key, query, header, data)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	// The server checked Content-MD5 already, the ETag is only the MD5 for unencrypted objects
+	if unquoted := strings.Trim(etag, `"`); len(unquoted) == 32 && unquoted != hex.EncodeToString(sum[:]) {
+		return "", fmt.Errorf("verification failed for %s: uploaded MD5 %s, stored %s", key, hex.EncodeToString(sum[:]), unquoted)
+	}
+	return etag, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipart runs a multipart upload, calling uploadPart for each part number until it reports the last part.
+// The upload is aborted when a part fails.
+func (s *s3Storage) multipart(key string, uploadPart func(uploadID string, number int) (string, bool, error)) error {
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, &initiated); err != nil {
+		return err
+	}
+
+	var parts []s3CompletedPart
+	for number := 1; ; number++ {
+		etag, last, err := uploadPart(initiated.UploadID, number)
+		if err != nil {
+			if resp, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: etag})
+		if last {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	return s.doXML(http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, body, nil)
+}
+
+// Put uploads the object and reads it back, so the digest it returns describes what the bucket stored.
+func (s *s3Storage) Put(name string, src io.Reader, size int64) (string, error) {
+	key := s.config.Prefix + name
+	hasher := sha256.New()
+	src = io.TeeReader(src, hasher)
+
+	if size <= s.partSize {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(src, data); err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		if _, err := s.putPart(key, nil, data); err != nil {
+			return "", err
+		}
+	} else {
+		buffer := make([]byte, s.partSize)
+		remaining := size
+		err := s.multipart(key, func(uploadID string, number int) (string, bool, error) {
+			partSize := int64(len(buffer))
+			if remaining < partSize {
+				partSize = remaining
+			}
+			if _, err := io.ReadFull(src, buffer[:partSize]); err != nil {
+				return "", false, fmt.Errorf("failed to read %s: %v", name, err)
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+			etag, err := s.putPart(key, query, buffer[:partSize])
+			remaining -= partSize
+			return etag, remaining == 0, err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	reader, err := s.OpenRange(name, 0, -1)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify %s: %v", s.Location(name), err)
+	}
+	defer reader.Close()
+	storedHasher := sha256.New()
+	stored, err := io.Copy(storedHasher, reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify %s: %v", s.Location(name), err)
+	}
+	if stored != size {
+		return "", fmt.Errorf("verification failed for %s: stored %d bytes, expected %d", s.Location(name), stored, size)
+	}
+	digest, sourceDigest := hex.EncodeToString(storedHasher.Sum(nil)), hex.EncodeToString(hasher.Sum(nil))
+	if digest != sourceDigest {
+		return "", fmt.Errorf("verification failed for %s: stored digest %s, uploaded %s", s.Location(name), digest, sourceDigest)
+	}
+	return digest, nil
+}
+
+func (s *s3Storage) Stat(name string) (StorageObject, error) {
+	resp, err := s.do(http.MethodHead, s.config.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return StorageObject{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageObject{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.config.Prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := s.doXML(http.MethodGet, "", query, nil, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, StorageObject{
+				Name:    strings.TrimPrefix(content.Key, s.config.Prefix),
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Move copies the object on the server and deletes the original, since S3 has no rename.
+func (s *s3Storage) Move(from, to string) error {
+	object, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	source := "/" + s.config.Bucket + "/" + s3Escape(s.config.Prefix+from, true)
+	key := s.config.Prefix + to
+
+	if object.Size <= s3MaxCopySize {
+		err = s.doXML(http.MethodPut, key, nil, http.Header{"X-Amz-Copy-Source": {source}}, nil, nil)
+	} else {
+		var offset int64
+		err = s.multipart(key, func(uploadID string, number int) (string, bool, error) {
+			end := offset + s3CopyPartSize
+			if end > object.Size {
+				end = object.Size
+			}
+			header := http.Header{
+				"X-Amz-Copy-Source":       {source},
+				"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", offset, end-1)},
+			}
+			var result struct {
+				ETag string `xml:"ETag"`
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+			if err := s.doXML(http.MethodPut, key, query, header, nil, &result); err != nil {
+				return "", false, err
+			}
+			offset = end
+			return result.ETag, offset == object.Size, nil
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %v", s.Location(from), s.Location(to), err)
+	}
+	return s.Delete(from)
+}
+
+func (s *s3Storage) Delete(name string) error {
+	resp, err := s.do(http.MethodDelete, s.config.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Storage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		// A Range header cannot select zero bytes
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	var header http.Header
+	if offset > 0 || length > 0 {
+		// A whole object is read without a range, which S3 would reject for an empty object
+		byteRange := fmt.Sprintf("bytes=%d-", offset)
+		if length > 0 {
+			byteRange += strconv.FormatInt(offset+length-1, 10)
+		}
+		header = http.Header{"Range": {byteRange}}
+	}
+	resp, err := s.do(http.MethodGet, s.config.Prefix+name, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Location(name string) string {
+	return "s3://" + s.config.Bucket + "/" + s.config.Prefix + name
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateStorageRejectsMemory(t *testing.T) {
+	if err := validateStorage(StorageConfig{Type: "memory"}); err == nil {
+		t.Fatal("memory storage accepted from the configuration")
+	}
+	if err := validateBackups("GOPRO", SDCard{Backups: []BackupDestination{{Name: "ram", StorageConfig: StorageConfig{Type: "memory"}}}}, currentSettings().paths); err == nil {
+		t.Fatal("memory backup destination accepted from the configuration")
+	}
+}
+
+func TestValidateBackupsUsesConfiguredArchiveRoot(t *testing.T) {
+	paths := resolvePaths(Config{DestinationConfig: DestinationConfig{Path: "/srv/archive"}})
+	sdCard := SDCard{Backups: []BackupDestination{{Name: "usb", StorageConfig: StorageConfig{Root: "/srv/archive/"}}}}
+	if err := validateBackups("GOPRO", sdCard, paths); err == nil {
+		t.Fatal("backup destination in the archive root of the new configuration accepted")
+	}
+	sdCard.Backups[0].Root = currentSettings().paths.ArchiveRoot
+	if err := validateBackups("GOPRO", sdCard, paths); err != nil {
+		t.Fatalf("backup destination rejected for the archive root of the running configuration: %v", err)
+	}
+}
+
+// fakeS3 is a path-style S3 endpoint for a single bucket, implementing the calls s3Storage makes.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+	corrupt bool // Store every object with its first byte flipped
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3Storage) {
+	t.Helper()
+	fake := &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	storage, err := newS3Storage(StorageConfig{
+		Type: StorageS3, Endpoint: server.URL, Bucket: "footage", Prefix: "archive/",
+		AccessKey: "key", SecretKey: "secret", PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.partSize = 4 // Every object above four bytes is uploaded in parts
+	return fake, storage
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") == "" {
+		http.Error(w, "unsigned request", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/footage"), "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		var data []byte
+		for number := 1; number <= len(parts); number++ {
+			data = append(data, parts[number]...)
+		}
+		delete(f.uploads, query.Get("uploadId"))
+		f.store(key, data)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodPut:
+		data := body
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			sourceKey, _ := url.PathUnescape(strings.TrimPrefix(source, "/footage/"))
+			data = f.objects[sourceKey]
+			if data == nil {
+				http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+				return
+			}
+			if byteRange := r.Header.Get("X-Amz-Copy-Source-Range"); byteRange != "" {
+				data = sliceRange(data, byteRange)
+			}
+		} else if sum := r.Header.Get("Content-Md5"); sum != "" {
+			digest := md5.Sum(body)
+			if sum != base64.StdEncoding.EncodeToString(digest[:]) {
+				http.Error(w, "<Error><Code>BadDigest</Code></Error>", http.StatusBadRequest)
+				return
+			}
+		}
+		digest := md5.Sum(data)
+		etag := `"` + hex.EncodeToString(digest[:]) + `"`
+		if id := query.Get("uploadId"); id != "" {
+			number, _ := strconv.Atoi(query.Get("partNumber"))
+			f.uploads[id][number] = append([]byte(nil), data...)
+		} else {
+			f.store(key, data)
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", etag)
+		}
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, exists := f.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		status := http.StatusOK
+		if byteRange := r.Header.Get("Range"); byteRange != "" {
+			first, last, _ := strings.Cut(strings.TrimPrefix(byteRange, "bytes="), "-")
+			start, errStart := strconv.Atoi(first)
+			end, errEnd := strconv.Atoi(last)
+			if errStart != nil || (last != "" && (errEnd != nil || end < start)) || start >= len(data) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			data, status = sliceRange(data, byteRange), http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		if id := query.Get("uploadId"); id != "" {
+			delete(f.uploads, id)
+		} else {
+			delete(f.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) store(key string, data []byte) {
+	data = append([]byte(nil), data...)
+	if f.corrupt && len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	f.objects[key] = data
+}
+
+// list answers ListObjectsV2 two keys at a time, so the continuation token is exercised.
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	end := start + 2
+	if end > len(keys) {
+		end = len(keys)
+	}
+	type content struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{IsTruncated: end < len(keys)}
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, content{key, len(f.objects[key]), time.Now().UTC().Format(time.RFC3339)})
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// sliceRange returns the bytes selected by a "bytes=first-last" or "bytes=first-" range.
+func sliceRange(data []byte, byteRange string) []byte {
+	first, last, _ := strings.Cut(strings.TrimPrefix(byteRange, "bytes="), "-")
+	start, _ := strconv.Atoi(first)
+	end := len(data)
+	if last != "" {
+		end, _ = strconv.Atoi(last)
+		end++
+	}
+	if start > len(data) {
+		start = len(data)
+	}
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end]
+}
+
+// storageContracts runs the same checks against every Storage implementation.
+func storageContracts(t *testing.T) map[string]Storage {
+	_, s3 := newFakeS3(t)
+	return map[string]Storage{
+		"memory": newMemoryStorage(),
+		"local":  &localStorage{root: t.TempDir()},
+		"s3":     s3,
+	}
+}
+
+func readAll(t *testing.T, storage Storage, name string, offset, length int64) string {
+	t.Helper()
+	reader, err := storage.OpenRange(name, offset, length)
+	if err != nil {
+		t.Fatalf("OpenRange(%s, %d, %d): %v", name, offset, length, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStorageContract(t *testing.T) {
+	for kind, storage := range storageContracts(t) {
+		t.Run(kind, func(t *testing.T) {
+			// Put returns the digest of what was stored, for single and multipart uploads alike
+			for name, content := range map[string]string{"GOPRO/GX010001.MP4": "first clip", "GOPRO/GX010002.MP4": "abc", "GOPRO/EMPTY.MP4": ""} {
+				digest, err := storage.Put(name, strings.NewReader(content), int64(len(content)))
+				if err != nil {
+					t.Fatalf("Put %s: %v", name, err)
+				}
+				if sum := sha256.Sum256([]byte(content)); digest != hex.EncodeToString(sum[:]) {
+					t.Errorf("Put %s returned digest %s", name, digest)
+				}
+			}
+			if _, err := storage.Put("GOPRO/SHORT.MP4", strings.NewReader("abc"), 10); err == nil {
+				t.Error("Put accepted a source shorter than its size")
+			}
+
+			object, err := storage.Stat("GOPRO/GX010001.MP4")
+			if err != nil || object.Size != 10 || object.Name != "GOPRO/GX010001.MP4" {
+				t.Errorf("Stat: %+v, %v", object, err)
+			}
+			if _, err := storage.Stat("GOPRO/MISSING.MP4"); !os.IsNotExist(err) {
+				t.Errorf("Stat of a missing object: %v", err)
+			}
+			if _, err := storage.OpenRange("GOPRO/MISSING.MP4", 0, -1); !os.IsNotExist(err) {
+				t.Errorf("OpenRange of a missing object: %v", err)
+			}
+
+			// Ranges
+			tests := []struct {
+				name           string
+				offset, length int64
+				want           string
+			}{
+				{"GOPRO/GX010001.MP4", 0, -1, "first clip"},
+				{"GOPRO/GX010001.MP4", 6, -1, "clip"},
+				{"GOPRO/GX010001.MP4", 2, 3, "rst"},
+				{"GOPRO/GX010001.MP4", 4, 0, ""},
+				{"GOPRO/EMPTY.MP4", 0, -1, ""},
+			}
+			for _, test := range tests {
+				if got := readAll(t, storage, test.name, test.offset, test.length); got != test.want {
+					t.Errorf("OpenRange(%s, %d, %d) = %q, want %q", test.name, test.offset, test.length, got, test.want)
+				}
+			}
+
+			// List returns the objects below a prefix, sorted by name
+			objects, err := storage.List("GOPRO/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, object := range objects {
+				names = append(names, object.Name)
+			}
+			if want := "GOPRO/EMPTY.MP4 GOPRO/GX010001.MP4 GOPRO/GX010002.MP4"; strings.Join(names, " ") != want {
+				t.Errorf("List: %v, want %s", names, want)
+			}
+
+			// Move into a folder that does not exist yet, then delete
+			if err := storage.Move("GOPRO/GX010001.MP4", "Projects/Trip/GX010001.MP4"); err != nil {
+				t.Fatalf("Move: %v", err)
+			}
+			if _, err := storage.Stat("GOPRO/GX010001.MP4"); !os.IsNotExist(err) {
+				t.Errorf("moved object still at its old name: %v", err)
+			}
+			if got := readAll(t, storage, "Projects/Trip/GX010001.MP4", 0, -1); got != "first clip" {
+				t.Errorf("moved object holds %q", got)
+			}
+			if err := storage.Delete("Projects/Trip/GX010001.MP4"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := storage.Stat("Projects/Trip/GX010001.MP4"); !os.IsNotExist(err) {
+				t.Errorf("deleted object still stored: %v", err)
+			}
+		})
+	}
+}
+
+func TestS3PutVerifiesStoredObject(t *testing.T) {
+	fake, storage := newFakeS3(t)
+	fake.corrupt = true
+	if _, err := storage.Put("GOPRO/GX010001.MP4", bytes.NewReader([]byte("first clip")), 10); err == nil {
+		t.Fatal("Put accepted an object the bucket stored differently")
+	}
+}
+
+func TestS3GivesUpOnUnresponsiveEndpoint(t *testing.T) {
+	saved := s3IdleTimeout
+	s3IdleTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { s3IdleTimeout = saved })
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	storage, err := newS3Storage(StorageConfig{Type: StorageS3, Endpoint: server.URL, Bucket: "footage", AccessKey: "key", SecretKey: "secret", PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Stat("GOPRO/GX010001.MP4"); err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
+
+// useTestOriginals keeps the originals in storage for the duration of the test.
+func useTestOriginals(t *testing.T, storage Storage) string {
+	t.Helper()
+	root := useTestArchive(t)
+	useTestSettings(t, func(settings *Settings) {
+		settings.originals = storage
+	})
+	return root
+}
+
+func TestManifestIsStoredWithOriginals(t *testing.T) {
+	storage := newMemoryStorage()
+	root := useTestOriginals(t, storage)
+	dir := filepath.Join(root, "GOPRO")
+	source := filepath.Join(t.TempDir(), "GX010001.MP4")
+	writeTestFile(t, source, "first clip")
+	if _, err := storeOriginal(context.Background(), source, filepath.Join(dir, "GX010001.MP4"), 10, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordManifest(dir, "GX010001.MP4", "digest"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.Stat("GOPRO/" + manifestFileName); err != nil {
+		t.Fatalf("manifest not in the storage of the originals: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, manifestFileName)); !os.IsNotExist(err) {
+		t.Errorf("manifest written below the archive root: %v", err)
+	}
+	entries, err := readManifest(dir)
+	if err != nil || entries["GX010001.MP4"] != "digest" {
+		t.Fatalf("got %v, %v", entries, err)
+	}
+	objects, err := currentSettings().listOriginals(dir)
+	if err != nil || len(objects) != 1 || objects[0].Name != "GOPRO/GX010001.MP4" {
+		t.Fatalf("listed %+v, %v", objects, err)
+	}
+}
+
+func TestMediaSourceUsesStorageRoot(t *testing.T) {
+	storageRoot := t.TempDir()
+	root := useTestOriginals(t, &localStorage{root: storageRoot})
+	if got, want := mediaSource(filepath.Join(root, "GOPRO", "GX010001.MP4")), filepath.Join(storageRoot, "GOPRO", "GX010001.MP4"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
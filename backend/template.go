@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Destination templates may contain the following placeholders, expanded per file:
+//
+//	{card}  the SD card name
+//	{yyyy}  four digit capture year
+//	{mm}    two digit capture month
+//	{dd}    two digit capture day
+//	{date}  capture date as yyyy-mm-dd
+//
+// The capture time comes from the container metadata, falling back to the modification time,
+// and is expressed in the configured timezone.
+
+// expandDestination expands the placeholders of a destination template, relative to the archive root.
+func expandDestination(template, card string, captured time.Time) string {
+	settings := currentSettings()
+	captured = captured.In(settings.timezone)
+	replacer := strings.NewReplacer(
+		"{card}", card,
+		"{yyyy}", captured.Format("2006"),
+		"{mm}", captured.Format("01"),
+		"{dd}", captured.Format("02"),
+		"{date}", captured.Format("2006-01-02"),
+	)
+	return settings.paths.archivePath(replacer.Replace(template))
+}
+
+// hasDatePlaceholders reports whether the template depends on the capture time of a file.
+func hasDatePlaceholders(template string) bool {
+	return strings.Contains(template, "{yyyy}") || strings.Contains(template, "{mm}") ||
+		strings.Contains(template, "{dd}") || strings.Contains(template, "{date}")
+}
+
+// destinationRoot returns the fixed directory that every expansion of the card's destination lives below.
+// For "RecentImports/{card}/{yyyy}/{mm}-{dd}" on card "OSMO" that is "RecentImports/OSMO" in the archive root.
+func destinationRoot(sdCard SDCard) string {
+	template := strings.ReplaceAll(sdCard.Destination, "{card}", sdCard.Name)
+	if !strings.Contains(template, "{") {
+		return currentSettings().paths.archivePath(template)
+	}
+
+	var root []string
+	for _, element := range strings.Split(template, string(filepath.Separator)) {
+		if strings.Contains(element, "{") {
+			break
+		}
+		root = append(root, element)
+	}
+	if len(root) == 1 && root[0] == "" {
+		return string(filepath.Separator)
+	}
+	return currentSettings().paths.archivePath(strings.Join(root, string(filepath.Separator)))
+}
+
+// destinationPattern returns a filepath.Match pattern matching every directory the card's destination expands to.
+func destinationPattern(sdCard SDCard) string {
+	escaper := strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+	digits := func(n int) string { return strings.Repeat("[0-9]", n) }
+	replacer := strings.NewReplacer(
+		"{card}", escaper.Replace(sdCard.Name),
+		"{yyyy}", digits(4),
+		"{mm}", digits(2),
+		"{dd}", digits(2),
+		"{date}", digits(4)+"-"+digits(2)+"-"+digits(2),
+	)
+	return replacer.Replace(escaper.Replace(currentSettings().paths.archivePath(sdCard.Destination)))
+}
+
+// ownsDir reports whether dir is a directory the card's destination expands to, or lies below one.
+// destinationRoot alone is not enough once the first folder of a template has placeholders: for "{date}_{card}"
+// the root is the archive root itself, which also holds the footage of every other card.
+func (sdCard SDCard) ownsDir(dir string) bool {
+	pattern := destinationPattern(sdCard)
+	archiveRoot := currentSettings().paths.ArchiveRoot
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if matched, _ := filepath.Match(pattern, dir); matched {
+			return true
+		}
+		if dir == archiveRoot || dir == "." || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// ownsPath reports whether the file at path was imported into the card's destination.
+func (sdCard SDCard) ownsPath(path string) bool {
+	return sdCard.ownsDir(filepath.Dir(path))
+}
+
+// captureTime returns when the clip was recorded, read from the container's creation_time tag with ffprobe.
+// The modification time is used when the tag is missing or ffprobe is not available.
+func captureTime(path string, info os.FileInfo) time.Time {
+	cmd := exec.Command(
+		"ffprobe", "-v", "quiet",
+		"-show_entries", "format_tags=creation_time",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	)
+	output, err := cmd.Output()
+	if err == nil {
+		value := strings.TrimSpace(string(output))
+		if captured, err := time.Parse(time.RFC3339Nano, value); err == nil && !captured.IsZero() {
+			return captured
+		}
+	}
+	return info.ModTime()
+}
+
+// walkMediaDirs calls fn for root and every directory below it that may hold imported footage.
+// Proxy profile folders are skipped since they only hold derived files.
+func walkMediaDirs(root string, fn func(dir string) error) error {
+	return filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // Skip unreadable subdirectories
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root && (isProxyFolder(entry.Name()) || strings.HasPrefix(entry.Name(), ".")) {
+			return filepath.SkipDir
+		}
+		return fn(path)
+	})
+}
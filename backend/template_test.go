@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandDestination(t *testing.T) {
+	root := useTestArchive(t)
+	captured := time.Date(2024, 5, 1, 23, 30, 0, 0, time.UTC)
+	if got := expandDestination("RecentImports/{card}/{yyyy}/{mm}-{dd}", "OSMO", captured); got != filepath.Join(root, "RecentImports/OSMO/2024/05-01") {
+		t.Errorf("got %s", got)
+	}
+	if got := expandDestination("{date}_{card}", "OSMO", captured); got != filepath.Join(root, "2024-05-01_OSMO") {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestOwnsPath(t *testing.T) {
+	root := useTestArchive(t)
+	tests := []struct {
+		destination string
+		path        string
+		owned       bool
+	}{
+		{"{date}_{card}", "2024-05-01_OSMO/DJI_0001.MP4", true},
+		{"{date}_{card}", "2024-05-01_GOPRO/GX010001.MP4", false},
+		{"{date}_{card}", "Projects/DJI_0001.MP4", false},
+		{"{date}_{card}", "2024-05-01_OSMO/DCIM/100MEDIA/DJI_0001.MP4", true}, // Preserved card structure
+		{"RecentImports/{card}/{yyyy}/{mm}-{dd}", "RecentImports/OSMO/2024/05-01/DJI_0001.MP4", true},
+		{"RecentImports/{card}/{yyyy}/{mm}-{dd}", "RecentImports/OSMO/DJI_0001.MP4", false},
+		{"RecentImports/{card}/{yyyy}/{mm}-{dd}", "RecentImports/OSMO2/2024/05-01/DJI_0001.MP4", false},
+		{"OSMO", "OSMO/DJI_0001.MP4", true},
+		{"OSMO", "OSMO_OLD/DJI_0001.MP4", false},
+	}
+	for _, test := range tests {
+		sdCard := SDCard{Name: "OSMO", Destination: test.destination}
+		if owned := sdCard.ownsPath(filepath.Join(root, test.path)); owned != test.owned {
+			t.Errorf("%s owns %s: got %v, want %v", test.destination, test.path, owned, test.owned)
+		}
+	}
+}
+
+func TestOwnsPathEscapesCardName(t *testing.T) {
+	root := useTestArchive(t)
+	sdCard := SDCard{Name: "CAM[1]", Destination: "{card}_{yyyy}"}
+	if !sdCard.ownsPath(filepath.Join(root, "CAM[1]_2024", "A.MP4")) {
+		t.Error("card name with glob characters not matched literally")
+	}
+	if sdCard.ownsPath(filepath.Join(root, "CAM1_2024", "A.MP4")) {
+		t.Error("card name matched as a glob pattern")
+	}
+}
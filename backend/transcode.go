@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TranscodePriority orders queued proxy jobs, lower values run first.
+type TranscodePriority int
+
+const (
+	PriorityIngest    TranscodePriority = iota // Proxies for footage that was just imported
+	PriorityReprocess                          // Bulk reprocessing of the archive
+)
+
+func (p TranscodePriority) String() string {
+	switch p {
+	case PriorityIngest:
+		return "ingest"
+	case PriorityReprocess:
+		return "reprocess"
+	default:
+		return "unknown"
+	}
+}
+
+// TranscodeTask is one proxy rendered by ffmpeg.
+type TranscodeTask struct {
+	ID        int64     `json:"id"`
+	Source    string    `json:"source"`
+	Output    string    `json:"output"`
+	Profile   string    `json:"profile"`
+	Priority  string    `json:"priority"`
+	State     string    `json:"state"`    // "queued" or "running"
+	Duration  float64   `json:"duration"` // Seconds of source footage
+	Percent   float64   `json:"percent"`
+	QueuedAt  time.Time `json:"queuedAt"`
+	StartedAt time.Time `json:"startedAt,omitempty"`
+
+	priority TranscodePriority
+	profile  ProxyProfile
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// TranscodeQueue runs proxy jobs on a fixed number of ffmpeg workers, highest priority first.
+type TranscodeQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	workers int
+	started int // Worker goroutines running, above workers while extra workers finish their task
+	nextID  int64
+	pending []*TranscodeTask
+	tasks   map[string]*TranscodeTask // Queued and running tasks keyed by output path
+}
+
+// NewTranscodeQueue creates a queue that runs at most workers ffmpeg processes at a time.
+func NewTranscodeQueue(workers int) *TranscodeQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &TranscodeQueue{
+		workers: workers,
+		tasks:   make(map[string]*TranscodeTask),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start launches the worker goroutines.
+func (q *TranscodeQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.startWorkersLocked()
+	logReceiver.Info("Started %d transcoding workers", q.workers)
+}
+
+// SetWorkers changes the number of ffmpeg processes run at a time. When the number drops,
+// the extra workers stop once their current task finishes.
+func (q *TranscodeQueue) SetWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if workers == q.workers {
+		return
+	}
+	q.workers = workers
+	if q.started > 0 {
+		q.startWorkersLocked()
+		q.cond.Broadcast() // Wake idle workers so extra ones stop
+	}
+	logReceiver.Info("Transcoding with %d workers", workers)
+}
+
+// startWorkersLocked launches workers until the configured number runs. The caller must hold q.mu.
+func (q *TranscodeQueue) startWorkersLocked() {
+	for ; q.started < q.workers; q.started++ {
+		go q.worker()
+	}
+}
+
+// Enqueue adds a proxy job. It returns false when a job for the same output is already queued or running.
+// The duration of the source in seconds is used to report progress.
+func (q *TranscodeQueue) Enqueue(source, output, profileName string, profile ProxyProfile, priority TranscodePriority, duration float64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if existing, exists := q.tasks[output]; exists {
+		// A fresh ingest promotes a queued reprocess of the same file
+		if priority < existing.priority {
+			existing.priority = priority
+			existing.Priority = priority.String()
+		}
+		return false
+	}
+
+	q.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &TranscodeTask{
+		ID:       q.nextID,
+		Source:   source,
+		Output:   output,
+		Profile:  profileName,
+		Priority: priority.String(),
+		State:    "queued",
+		Duration: duration,
+		QueuedAt: time.Now(),
+		priority: priority,
+		profile:  profile,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	q.pending = append(q.pending, task)
+	q.tasks[output] = task
+	q.cond.Signal()
+	return true
+}
+
+// Cancel stops a queued or running task. It returns false if no task has the given ID.
+func (q *TranscodeQueue) Cancel(id int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, task := range q.tasks {
+		if task.ID == id {
+			q.cancelLocked(task)
+			return true
+		}
+	}
+	return false
+}
+
+// CancelAll stops every queued and running task and returns how many were cancelled.
+func (q *TranscodeQueue) CancelAll() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := 0
+	for _, task := range q.tasks {
+		q.cancelLocked(task)
+		count++
+	}
+	return count
+}
+
+// Snapshot returns the queued and running tasks in the order they will run.
+func (q *TranscodeQueue) Snapshot() []TranscodeTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tasks := make([]TranscodeTask, 0, len(q.tasks))
+	for _, task := range q.tasks {
+		tasks = append(tasks, *task)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].State != tasks[j].State {
+			return tasks[i].State == "running"
+		}
+		if tasks[i].priority != tasks[j].priority {
+			return tasks[i].priority < tasks[j].priority
+		}
+		return tasks[i].ID < tasks[j].ID
+	})
+	return tasks
+}
+
+// cancelLocked cancels a task and drops it from the pending list. The caller must hold q.mu.
+func (q *TranscodeQueue) cancelLocked(task *TranscodeTask) {
+	task.cancel()
+	if task.State == "queued" {
+		for i, pending := range q.pending {
+			if pending == task {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		delete(q.tasks, task.Output)
+		logReceiver.WithFile(task.Source).WithField("profile", task.Profile).Info("Cancelled queued proxy for %s (%s)", task.Source, task.Profile)
+	}
+}
+
+// popLocked removes and returns the highest priority pending task, oldest first. The caller must hold q.mu.
+func (q *TranscodeQueue) popLocked() *TranscodeTask {
+	best := 0
+	for i, task := range q.pending {
+		if task.priority < q.pending[best].priority ||
+			(task.priority == q.pending[best].priority && task.ID < q.pending[best].ID) {
+			best = i
+		}
+	}
+	task := q.pending[best]
+	q.pending = append(q.pending[:best], q.pending[best+1:]...)
+	return task
+}
+
+// worker runs tasks until the process exits or the number of workers is reduced.
+func (q *TranscodeQueue) worker() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && q.started <= q.workers {
+			q.cond.Wait()
+		}
+		if q.started > q.workers {
+			q.started--
+			q.mu.Unlock()
+			return
+		}
+		task := q.popLocked()
+		task.State = "running"
+		task.StartedAt = time.Now()
+		q.mu.Unlock()
+
+		q.run(task)
+
+		q.mu.Lock()
+		delete(q.tasks, task.Output)
+		q.mu.Unlock()
+	}
+}
+
+// run renders a single proxy, publishing progress parsed from `ffmpeg -progress`.
+// ffmpeg writes to a partial file that only replaces the output once it exits successfully, since an existing
+// output is taken as a finished proxy. A render cut short by a crash leaves just the partial file, which the next
+// render overwrites.
+func (q *TranscodeQueue) run(task *TranscodeTask) {
+	partialPath := task.Output + partialSuffix
+	args := append([]string{"-y", "-nostats", "-progress", "pipe:1"}, task.profile.ffmpegArgs(mediaSource(task.Source), partialPath)...)
+	cmd := exec.CommandContext(task.ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err == nil {
+		parseFFmpegProgress(stdout, transcodeProgressReporter(task, time.Now(), func(percent float64) {
+			q.mu.Lock()
+			task.Percent = percent
+			q.mu.Unlock()
+		}))
+		err = cmd.Wait()
+	}
+
+	if err == nil {
+		if err = os.Rename(partialPath, task.Output); err != nil {
+			err = fmt.Errorf("failed to rename %s: %v", partialPath, err)
+		}
+	}
+	logger := logReceiver.WithFile(task.Source).WithField("profile", task.Profile)
+	if err != nil {
+		os.Remove(partialPath)
+		logReceiver.Progress(ProgressEvent{Kind: "transcode", File: task.Source, Profile: task.Profile, Done: true, Failed: true})
+		if task.ctx.Err() != nil {
+			logger.Info("Cancelled %s proxy for %s", task.Profile, task.Source)
+			return
+		}
+		logger.WithField("output", stderr.String()).Error("Failed to create %s proxy for %s: %v", task.Profile, task.Source, err)
+		return
+	}
+	task.cancel()
+	logger.Info("Created proxy for %s (%s)", task.Source, task.Profile)
+}
+
+// HandleTranscodes handles GET /api/transcodes, listing queued and running proxy jobs.
+func HandleTranscodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transcodeQueue.Snapshot())
+}
+
+// CancelTranscodes handles POST /api/transcodes/cancel with either {"id": n} or {"all": true}.
+func CancelTranscodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		ID  int64 `json:"id"`
+		All bool  `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if request.All {
+		count := transcodeQueue.CancelAll()
+		fmt.Fprintf(w, "Cancelled %d transcodes\n", count)
+		return
+	}
+	if !transcodeQueue.Cancel(request.ID) {
+		http.Error(w, fmt.Sprintf("Transcode %d not found", request.ID), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "Cancelled transcode %d\n", request.ID)
+}
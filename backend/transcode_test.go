@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useFakeFFmpeg puts an ffmpeg on the PATH that writes its output file and exits with the given status.
+func useFakeFFmpeg(t *testing.T, status int) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor last; do :; done\necho proxy > \"$last\"\nexit " + strconv.Itoa(status) + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func runTestTranscode(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	output := filepath.Join(dir, "Proxy", "DJI_0001.mp4")
+	if err := os.MkdirAll(filepath.Dir(output), 0777); err != nil {
+		t.Fatal(err)
+	}
+	q := NewTranscodeQueue(1)
+	q.Enqueue(filepath.Join(dir, "DJI_0001.MP4"), output, defaultProxyProfileName, defaultProxyProfile, PriorityIngest, 0)
+	q.run(q.popLocked())
+	return output
+}
+
+func TestTranscodeRenamesFinishedProxy(t *testing.T) {
+	useFakeFFmpeg(t, 0)
+	output := runTestTranscode(t)
+	if !verifyFileExists(output) {
+		t.Fatal("finished proxy not at its output path")
+	}
+	if verifyFileExists(output + partialSuffix) {
+		t.Fatal("partial file left behind")
+	}
+}
+
+func TestTranscodeDropsFailedProxy(t *testing.T) {
+	useFakeFFmpeg(t, 1)
+	output := runTestTranscode(t)
+	if verifyFileExists(output) || verifyFileExists(output+partialSuffix) {
+		t.Fatal("failed render left an output behind")
+	}
+}
+
+func TestTranscodeQueueSetWorkers(t *testing.T) {
+	q := NewTranscodeQueue(1)
+	q.Start()
+	q.SetWorkers(3)
+	q.mu.Lock()
+	started := q.started
+	q.mu.Unlock()
+	if started != 3 {
+		t.Fatalf("started %d workers, want 3", started)
+	}
+
+	q.SetWorkers(1)
+	deadline := time.Now().Add(time.Second)
+	for {
+		q.mu.Lock()
+		started = q.started
+		q.mu.Unlock()
+		if started == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers left, want 1", started)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// deviceIDDir is the udev directory that holds one symlink per block device with a filesystem, named by its UUID.
+// Unlike by-label it also lists unlabeled cards and cards that share a default label such as "NO NAME".
+const deviceIDDir = "/dev/disk/by-uuid"
+
+// DeviceEventType identifies whether a device appeared or disappeared.
+type DeviceEventType int
+
+const (
+	DeviceAdded DeviceEventType = iota
+	DeviceRemoved
+)
+
+func (t DeviceEventType) String() string {
+	switch t {
+	case DeviceAdded:
+		return "added"
+	case DeviceRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// DeviceEvent is emitted by a DeviceWatcher when a filesystem device is inserted or removed.
+type DeviceEvent struct {
+	Type DeviceEventType
+	ID   string // Filesystem UUID
+}
+
+// DeviceWatcher reports device insert/remove events on a channel.
+// Start emits an Added event for every device that is already present.
+type DeviceWatcher interface {
+	Start() (<-chan DeviceEvent, error)
+	Stop()
+}
+
+// newDeviceWatcher creates the watcher selected by the configuration.
+// "auto" (or an empty value) tries inotify, then netlink, then falls back to polling.
+func newDeviceWatcher(kind string) (DeviceWatcher, error) {
+	switch kind {
+	case "", "auto":
+		iw, err := newInotifyWatcher(deviceIDDir)
+		if err == nil {
+			return iw, nil
+		}
+		logReceiver.Warn("inotify device watcher unavailable: %v", err)
+
+		nw, err := newNetlinkWatcher(deviceIDDir)
+		if err == nil {
+			return nw, nil
+		}
+		logReceiver.Warn("netlink device watcher unavailable: %v", err)
+
+		return newPollingWatcher(deviceIDDir, 5*time.Second), nil
+	case "inotify":
+		return newInotifyWatcher(deviceIDDir)
+	case "netlink":
+		return newNetlinkWatcher(deviceIDDir)
+	case "poll":
+		return newPollingWatcher(deviceIDDir, 5*time.Second), nil
+	default:
+		return nil, fmt.Errorf("unknown device watcher type: %s", kind)
+	}
+}
+
+// scanDeviceIDs returns the set of device IDs currently present in dir.
+// A missing directory simply means no devices are connected.
+func scanDeviceIDs(dir string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ids, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		ids[entry.Name()] = true
+	}
+	return ids, nil
+}
+
+// deviceTracker remembers the last seen set of devices and turns rescans into Added/Removed events.
+type deviceTracker struct {
+	dir    string
+	known  map[string]bool
+	events chan DeviceEvent
+}
+
+func newDeviceTracker(dir string) *deviceTracker {
+	return &deviceTracker{
+		dir:    dir,
+		known:  make(map[string]bool),
+		events: make(chan DeviceEvent, 16),
+	}
+}
+
+// rescan reads the device directory and emits events for every difference since the last scan.
+func (t *deviceTracker) rescan() {
+	current, err := scanDeviceIDs(t.dir)
+	if err != nil {
+		logReceiver.Error("Error reading %s: %v", t.dir, err)
+		return
+	}
+	for _, event := range diffDevices(t.known, current) {
+		t.events <- event
+	}
+	t.known = current
+}
+
+// diffDevices compares two device sets and returns the resulting events in a stable order.
+func diffDevices(previous, current map[string]bool) []DeviceEvent {
+	var events []DeviceEvent
+	for id := range previous {
+		if !current[id] {
+			events = append(events, DeviceEvent{Type: DeviceRemoved, ID: id})
+		}
+	}
+	for id := range current {
+		if !previous[id] {
+			events = append(events, DeviceEvent{Type: DeviceAdded, ID: id})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type > events[j].Type // Removals first
+		}
+		return events[i].ID < events[j].ID
+	})
+	return events
+}
+
+// pollingWatcher rescans the device directory on a fixed interval.
+type pollingWatcher struct {
+	tracker  *deviceTracker
+	interval time.Duration
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newPollingWatcher(dir string, interval time.Duration) *pollingWatcher {
+	return &pollingWatcher{
+		tracker:  newDeviceTracker(dir),
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins polling and returns the event channel.
+func (w *pollingWatcher) Start() (<-chan DeviceEvent, error) {
+	go func() {
+		defer close(w.tracker.events)
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		w.tracker.rescan()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+				w.tracker.rescan()
+			}
+		}
+	}()
+	logReceiver.Info("Watching %s by polling every %s", w.tracker.dir, w.interval)
+	return w.tracker.events, nil
+}
+
+// Stop stops polling and closes the event channel.
+func (w *pollingWatcher) Stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// inotifyWatcher rescans the device directory whenever inotify reports a change in it.
+// The parent directory is watched as well because udev removes by-uuid when the last device with a filesystem goes away.
+type inotifyWatcher struct {
+	tracker *deviceTracker
+	file    *os.File
+	fd      int
+	once    sync.Once
+}
+
+func newInotifyWatcher(dir string) (*inotifyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %v", err)
+	}
+	w := &inotifyWatcher{
+		tracker: newDeviceTracker(dir),
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+	}
+	parentMask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(dir), parentMask); err != nil {
+		w.file.Close()
+		return nil, fmt.Errorf("failed to watch %s: %v", filepath.Dir(dir), err)
+	}
+	w.addDeviceWatch()
+	return w, nil
+}
+
+// addDeviceWatch (re)adds the watch on the device directory; it is a no-op while the directory does not exist.
+func (w *inotifyWatcher) addDeviceWatch() {
+	mask := uint32(syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM)
+	syscall.InotifyAddWatch(w.fd, w.tracker.dir, mask)
+}
+
+// Start begins reading inotify events and returns the event channel.
+func (w *inotifyWatcher) Start() (<-chan DeviceEvent, error) {
+	go func() {
+		defer close(w.tracker.events)
+		w.tracker.rescan()
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			// The content of the events does not matter, any change triggers a full rescan
+			if _, err := w.file.Read(buf); err != nil {
+				return
+			}
+			w.addDeviceWatch()
+			w.tracker.rescan()
+		}
+	}()
+	logReceiver.Info("Watching %s with inotify", w.tracker.dir)
+	return w.tracker.events, nil
+}
+
+// Stop closes the inotify descriptor, which ends the read loop and closes the event channel.
+func (w *inotifyWatcher) Stop() {
+	w.once.Do(func() { w.file.Close() })
+}
+
+// netlinkWatcher listens for kernel block device uevents and rescans the device directory after each one.
+// udev creates the by-uuid symlinks slightly after the kernel event, so rescans are delayed and debounced.
+type netlinkWatcher struct {
+	tracker *deviceTracker
+	file    *os.File
+	once    sync.Once
+}
+
+const netlinkSettleDelay = 1500 * time.Millisecond
+
+func newNetlinkWatcher(dir string) (*netlinkWatcher, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %v", err)
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1, Pid: 0}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+	return &netlinkWatcher{
+		tracker: newDeviceTracker(dir),
+		file:    os.NewFile(uintptr(fd), "netlink-uevent"),
+	}, nil
+}
+
+// Start begins reading uevents and returns the event channel.
+func (w *netlinkWatcher) Start() (<-chan DeviceEvent, error) {
+	changed := make(chan struct{}, 1)
+
+	go func() {
+		defer close(changed)
+		buf := make([]byte, 8192)
+		for {
+			n, err := w.file.Read(buf)
+			if err != nil {
+				return
+			}
+			if isBlockUevent(buf[:n]) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer close(w.tracker.events)
+		w.tracker.rescan()
+		for range changed {
+			time.Sleep(netlinkSettleDelay)
+			// Drain anything that arrived while waiting for udev to settle
+			select {
+			case _, ok := <-changed:
+				if !ok {
+					return
+				}
+			default:
+			}
+			w.tracker.rescan()
+		}
+	}()
+
+	logReceiver.Info("Watching block device uevents via netlink")
+	return w.tracker.events, nil
+}
+
+// Stop closes the netlink socket, which ends the read loop and closes the event channel.
+func (w *netlinkWatcher) Stop() {
+	w.once.Do(func() { w.file.Close() })
+}
+
+// isBlockUevent reports whether a raw kernel uevent message concerns the block subsystem.
+// Messages are NUL separated KEY=VALUE pairs preceded by an "action@devpath" header.
+func isBlockUevent(msg []byte) bool {
+	start := 0
+	for i := 0; i <= len(msg); i++ {
+		if i == len(msg) || msg[i] == 0 {
+			if string(msg[start:i]) == "SUBSYSTEM=block" {
+				return true
+			}
+			start = i + 1
+		}
+	}
+	return false
+}
+
+// FakeDeviceWatcher is an in-memory DeviceWatcher driven by Insert and Remove calls.
+// It lets the insert/remove handling be exercised without real block devices.
+type FakeDeviceWatcher struct {
+	mu      sync.Mutex
+	present map[string]bool
+	events  chan DeviceEvent
+	stopped bool
+}
+
+// NewFakeDeviceWatcher creates a fake watcher with the given device IDs already present.
+func NewFakeDeviceWatcher(initial ...string) *FakeDeviceWatcher {
+	present := make(map[string]bool)
+	for _, id := range initial {
+		present[id] = true
+	}
+	return &FakeDeviceWatcher{
+		present: present,
+		events:  make(chan DeviceEvent, 64),
+	}
+}
+
+// Start emits Added events for the initial devices and returns the event channel.
+func (f *FakeDeviceWatcher) Start() (<-chan DeviceEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, event := range diffDevices(nil, f.present) {
+		f.events <- event
+	}
+	return f.events, nil
+}
+
+// Insert simulates a device with the given ID being connected.
+func (f *FakeDeviceWatcher) Insert(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped || f.present[id] {
+		return
+	}
+	f.present[id] = true
+	f.events <- DeviceEvent{Type: DeviceAdded, ID: id}
+}
+
+// Remove simulates a device with the given ID being disconnected.
+func (f *FakeDeviceWatcher) Remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped || !f.present[id] {
+		return
+	}
+	delete(f.present, id)
+	f.events <- DeviceEvent{Type: DeviceRemoved, ID: id}
+}
+
+// Stop closes the event channel.
+func (f *FakeDeviceWatcher) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.stopped {
+		f.stopped = true
+		close(f.events)
+	}
+}
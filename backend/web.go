@@ -7,8 +7,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
@@ -28,77 +29,191 @@ type ProxyFile struct {
 
 var configLock sync.Mutex // To ensure thread-safe updates to the config file
 
-// loadConfig loads the configuration from a JSON file.
-func loadConfig(filePath string) error {
+// readConfig decodes the configuration file.
+func readConfig(filePath string) (Config, error) {
+	var config Config
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open config file: %v", err)
+		return config, fmt.Errorf("failed to open config file: %v", err)
 	}
 	defer file.Close()
 
-	var config Config
 	decoder := json.NewDecoder(file)
 	if err := decoder.Decode(&config); err != nil {
-		return fmt.Errorf("failed to decode config file: %v", err)
+		return config, fmt.Errorf("failed to decode config file: %v", err)
 	}
+	return config, nil
+}
+
+// configGate applies configuration changes between imports. A running import keeps the settings it started with,
+// however often it calls currentSettings, and an import starting while a change waits for the running ones
+// picks up the new configuration. Readers outside imports see a change as soon as it is applied.
+type configGate struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	imports int    // Running imports
+	pending func() // Assigns a loaded configuration once the running imports finish
+}
+
+var configs = newConfigGate()
 
-	sdCardMappings = config.SDCardMappings
-	ignoredExtensions = config.IgnoredExtensions
-	destinationConfig = config.DestinationConfig // Load destinationConfig
+func newConfigGate() *configGate {
+	g := &configGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
 
+// enter registers a starting import, waiting while a configuration change is pending.
+func (g *configGate) enter() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending != nil {
+		logReceiver.Info("Waiting for the running imports to finish before applying the new configuration")
+	}
+	for g.pending != nil {
+		g.cond.Wait()
+	}
+	g.imports++
+}
+
+// leave registers a finished import and applies a pending configuration after the last one.
+func (g *configGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.imports--
+	if g.imports == 0 && g.pending != nil {
+		g.pending()
+		g.pending = nil
+		g.cond.Broadcast()
+		logReceiver.Info("Applied the configuration saved during the import")
+	}
+}
+
+// apply runs assign now when no import is running, otherwise once the running imports finish.
+// It reports whether the configuration was applied immediately.
+func (g *configGate) apply(assign func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.imports == 0 {
+		assign()
+		return true
+	}
+	g.pending = assign // A newer configuration replaces one that is still waiting
+	return false
+}
+
+// loadConfig loads the configuration from a JSON file and applies it through the config gate.
+func loadConfig(filePath string) error {
+	config, err := readConfig(filePath)
+	if err != nil {
+		return err
+	}
 	// Load the time zone from the configuration
-	timezone, err = time.LoadLocation(config.Timezone)
+	location, err := time.LoadLocation(config.Timezone)
 	if err != nil {
 		return fmt.Errorf("failed to load timezone: %v", err)
 	}
 
+	// Open the storage before anything is applied, so a failure leaves the running configuration untouched
+	paths := resolvePaths(config)
+	storage, err := newStorage(config.Originals, paths.ArchiveRoot)
+	if err != nil {
+		return err
+	}
+
+	settings := &Settings{
+		sdCardMappings:    config.SDCardMappings,
+		ignoredExtensions: config.IgnoredExtensions,
+		timezone:          location,
+		destinationConfig: config.DestinationConfig,
+		paths:             paths,
+		spaceConfig:       config.FreeSpace,
+		originals:         storage,
+		deviceWatcherType: config.DeviceWatcher, // Only read at startup, a new watcher needs a restart
+		proxyProfiles:     config.ProxyProfiles,
+		cameraProfiles:    config.CameraProfiles,
+		previewProfile:    config.PreviewProfile,
+		proxyInputFormats: config.ProxyInputFormats,
+		transcodeWorkers:  config.TranscodeWorkers,
+		logBackfill:       config.LogBackfill,
+		logRetentionDays:  config.LogRetentionDays,
+	}
+	if !configs.apply(func() { applySettings(settings) }) {
+		logReceiver.Info("Configuration saved, it is applied once the running imports finish")
+	}
 	return nil
 }
 
+// applySettings makes settings the running configuration.
+func applySettings(settings *Settings) {
+	activeSettings.Store(settings)
+	if transcodeQueue != nil {
+		transcodeQueue.SetWorkers(settings.transcodeWorkers)
+	}
+}
+
 // ListProxyFiles lists all files in the destination directories, including those without proxies.
+// The files are taken from the media catalog rather than walking the destinations on every request.
+// Until a catalog scan has completed, e.g. right after startup or during a rescan, the destinations are walked instead.
 func ListProxyFiles(w http.ResponseWriter, r *http.Request) {
 	var proxies []ProxyFile
 
-	for _, sdCard := range sdCardMappings {
-		destinationFolder := sdCard.Destination
-		proxyFolder := filepath.Join(destinationFolder, "Proxy")
-
-		files, err := os.ReadDir(destinationFolder)
-		if err != nil {
-			logReceiver.Log("Error reading destination folder %s: %v", destinationFolder, err)
-			continue
+	settings := currentSettings()
+	var originalPaths []string
+	if catalog.Scanned() {
+		for _, info := range catalog.All() {
+			if inCardDestination(info.Path) && !shouldIgnoreFile(info.Path) {
+				originalPaths = append(originalPaths, info.Path)
+			}
 		}
-
-		for _, file := range files {
-			if file.IsDir() || shouldIgnoreFile(file.Name()) {
-				continue
+	} else {
+		seen := make(map[string]bool)
+		for _, sdCard := range settings.sdCardMappings {
+			for _, path := range cardFiles(sdCard) {
+				if !seen[path] {
+					seen[path] = true
+					originalPaths = append(originalPaths, path)
+				}
 			}
+		}
+	}
+	sort.Strings(originalPaths)
 
-			originalFilePath := filepath.Join(destinationFolder, file.Name())
-			proxyFilePath := filepath.Join(proxyFolder, file.Name())
-
-			// Check if the proxy exists
-			proxyPath := ""
-			if _, err := os.Stat(proxyFilePath); err == nil {
-				proxyPath = "/media" + strings.TrimPrefix(proxyFilePath, "/media/nfs/video_archive")
-			}
+	for _, originalFilePath := range originalPaths {
+		// The browser shows the preview profile, which lives in its folder next to the original
+		proxyFilePath := previewProxyPath(originalFilePath)
 
-			proxies = append(proxies, ProxyFile{
-				Original:        originalFilePath,
-				Proxy:           proxyPath, // Empty if no proxy exists
-				DisplayOriginal: strings.TrimPrefix(originalFilePath, "/media/nfs/video_archive/RecentImports/"),
-			})
+		// Empty if the proxy does not exist
+		proxyPath := ""
+		if proxyFilePath != "" {
+			proxyPath = settings.paths.mediaURL(proxyFilePath)
 		}
+
+		proxies = append(proxies, ProxyFile{
+			Original:        originalFilePath,
+			Proxy:           proxyPath, // Empty if no proxy exists
+			DisplayOriginal: settings.paths.displayName(originalFilePath),
+		})
 	}
 
-	logReceiver.Log("Listed %d files (including those without proxies)", len(proxies))
+	logReceiver.Debug("Listed %d files (including those without proxies)", len(proxies))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(proxies)
 }
 
-// ListDestinations lists all folders in /media/nfs/video_archive.
+// inCardDestination reports whether path lies in the destination of any SD card mapping.
+func inCardDestination(path string) bool {
+	for _, sdCard := range currentSettings().sdCardMappings {
+		if sdCard.ownsPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListDestinations lists all folders in the archive root.
 func ListDestinations(w http.ResponseWriter, r *http.Request) {
-	basePath := "/media/nfs/video_archive"
+	basePath := currentSettings().paths.ArchiveRoot
 	var destinations []string
 
 	entries, err := os.ReadDir(basePath)
@@ -117,7 +232,7 @@ func ListDestinations(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(destinations)
 }
 
-// CreateDestination creates a new folder in /media/nfs/video_archive.
+// CreateDestination creates a new folder in the archive root.
 func CreateDestination(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		FolderName string `json:"folderName"`
@@ -128,7 +243,7 @@ func CreateDestination(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newFolderPath := filepath.Join("/media/nfs/video_archive", request.FolderName)
+	newFolderPath := filepath.Join(currentSettings().paths.ArchiveRoot, filepath.Clean("/"+request.FolderName))
 	if err := os.MkdirAll(newFolderPath, 0777); err != nil { // Explicitly set permissions to 0777
 		http.Error(w, fmt.Sprintf("Error creating folder: %v", err), http.StatusInternalServerError)
 		return
@@ -183,21 +298,73 @@ func MoveFiles(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Destination folder does not exist", http.StatusBadRequest)
 		return
 	}
+	settings := currentSettings()
+	destinationKey, err := settings.archiveKey(destinationPath)
+	if err != nil && filepath.Clean(destinationPath) != settings.paths.ArchiveRoot {
+		http.Error(w, fmt.Sprintf("Error determining destination path: %v", err), http.StatusBadRequest)
+		return
+	}
 
 	// Move files to the destination
 	for _, file := range request.Files {
-		sourcePath := filepath.Join("/media/nfs", file) // Adjust source path as needed
-		destinationFilePath := filepath.Join(destinationPath, filepath.Base(file))
-		if err := os.Rename(sourcePath, destinationFilePath); err != nil {
+		sourcePath := file
+		if !filepath.IsAbs(sourcePath) {
+			sourcePath = settings.paths.archivePath(file)
+		}
+		sourceDir := filepath.Dir(sourcePath)
+		fileName := filepath.Base(sourcePath)
+		destinationFilePath := filepath.Join(destinationPath, fileName)
+		sourceKey, err := settings.archiveKey(sourcePath)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error moving file %s: %v", file, err), http.StatusBadRequest)
+			return
+		}
+		if err := settings.originals.Move(sourceKey, path.Join(destinationKey, fileName)); err != nil {
 			http.Error(w, fmt.Sprintf("Error moving file %s: %v", file, err), http.StatusInternalServerError)
 			return
 		}
 
 		// Verify the file exists at the destination before deleting the source
-		if !verifyFileExists(destinationFilePath) {
+		if !settings.originalExists(destinationFilePath) {
 			http.Error(w, fmt.Sprintf("File %s not found at destination after move", file), http.StatusInternalServerError)
 			return
 		}
+
+		// Every profile keeps its proxy in a folder next to the original, which may be a nested dated folder
+		for _, profile := range allProxyProfiles() {
+			proxyPath := proxyPathFor(sourcePath, profile)
+			if !verifyFileExists(proxyPath) {
+				continue
+			}
+			destinationProxyPath := proxyPathFor(destinationFilePath, profile)
+			if err := os.MkdirAll(filepath.Dir(destinationProxyPath), 0777); err != nil {
+				http.Error(w, fmt.Sprintf("Error creating %s folder: %v", profile.Folder, err), http.StatusInternalServerError)
+				return
+			}
+			if err := os.Rename(proxyPath, destinationProxyPath); err != nil {
+				http.Error(w, fmt.Sprintf("Error moving proxy for %s: %v", file, err), http.StatusInternalServerError)
+				return
+			}
+		}
+		// A preview proxy rendered before proxy profiles existed keeps its legacy name
+		if legacyPath := legacyProxyPath(sourcePath); verifyFileExists(legacyPath) {
+			destinationProxyPath := legacyProxyPath(destinationFilePath)
+			if err := os.MkdirAll(filepath.Dir(destinationProxyPath), 0777); err != nil {
+				http.Error(w, fmt.Sprintf("Error creating %s folder: %v", defaultProxyProfile.Folder, err), http.StatusInternalServerError)
+				return
+			}
+			if err := os.Rename(legacyPath, destinationProxyPath); err != nil {
+				http.Error(w, fmt.Sprintf("Error moving proxy for %s: %v", file, err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := moveManifestEntry(sourceDir, destinationPath, fileName); err != nil {
+			logReceiver.WithFile(file).Error("Error updating manifest for %s: %v", file, err)
+		}
+		if err := catalog.Move(sourcePath, destinationFilePath); err != nil {
+			logReceiver.WithFile(file).Error("Error updating catalog for %s: %v", file, err)
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -223,9 +390,9 @@ func ReprocessProxies(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go func() {
-		for _, sdCard := range sdCardMappings {
-			if err := createProxies(sdCard); err != nil {
-				logReceiver.Log("Error reprocessing proxies for SD card %s: %v", sdCard.Name, err)
+		for _, sdCard := range currentSettings().sdCardMappings {
+			if err := createProxies(sdCard, PriorityReprocess); err != nil {
+				logReceiver.WithDevice(sdCard.Name).Error("Error reprocessing proxies for SD card %s: %v", sdCard.Name, err)
 			}
 		}
 	}()
@@ -256,13 +423,15 @@ func DeleteVideo(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Attempting to delete proxy file: %s", request.Proxy)
 
 	// Correct the proxy file path
-	if !strings.HasPrefix(request.Proxy, "/media/nfs/video_archive") {
-		request.Proxy = filepath.Join("/media/nfs/video_archive", strings.TrimPrefix(request.Proxy, "/media"))
+	settings := currentSettings()
+	if proxyPath := settings.paths.mediaFile(request.Proxy); proxyPath != request.Proxy {
+		request.Proxy = proxyPath
 		log.Printf("Corrected proxy file path: %s", request.Proxy)
 	}
 
 	// Check if both files exist
-	if _, err := os.Stat(request.Original); os.IsNotExist(err) {
+	originalKey, err := settings.archiveKey(request.Original)
+	if err != nil || !settings.originalExists(request.Original) {
 		http.Error(w, fmt.Sprintf("Original file does not exist: %s", request.Original), http.StatusNotFound)
 		return
 	}
@@ -271,24 +440,37 @@ func DeleteVideo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Delete the proxy file first, so a failure leaves the original in place
+	if err := os.Remove(request.Proxy); err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting proxy file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
 	// Delete the high-resolution video
-	if err := os.Remove(request.Original); err != nil {
+	if err := settings.originals.Delete(originalKey); err != nil {
 		http.Error(w, fmt.Sprintf("Error deleting original file: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Delete the proxy file
-	if err := os.Remove(request.Proxy); err != nil {
-		// If deleting the proxy fails, restore the original file
-		log.Printf("Error deleting proxy file: %v. Restoring original file: %s", err, request.Original)
-		if restoreErr := os.Rename(request.Original+".bak", request.Original); restoreErr != nil {
-			log.Printf("Failed to restore original file: %v", restoreErr)
+	// Delete the proxies of the other profiles and a legacy preview proxy as well
+	proxyPaths := []string{legacyProxyPath(request.Original)}
+	for _, profile := range allProxyProfiles() {
+		proxyPaths = append(proxyPaths, proxyPathFor(request.Original, profile))
+	}
+	for _, proxyPath := range proxyPaths {
+		if proxyPath == request.Proxy {
+			continue
 		}
-		http.Error(w, fmt.Sprintf("Error deleting proxy file: %v", err), http.StatusInternalServerError)
-		return
+		if err := os.Remove(proxyPath); err != nil && !os.IsNotExist(err) {
+			logReceiver.WithFile(proxyPath).Error("Error deleting proxy %s: %v", proxyPath, err)
+		}
+	}
+
+	if err := catalog.Remove(request.Original); err != nil {
+		logReceiver.WithFile(request.Original).Error("Error updating catalog for %s: %v", request.Original, err)
 	}
 
-	logReceiver.Log("Deleted video: %s and proxy: %s", request.Original, request.Proxy)
+	logReceiver.WithFile(request.Original).Info("Deleted video: %s and proxy: %s", request.Original, request.Proxy)
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintln(w, "Video and proxy deleted successfully")
 }
@@ -298,7 +480,7 @@ func FetchConfig(w http.ResponseWriter, r *http.Request) {
 	configLock.Lock()
 	defer configLock.Unlock()
 
-	configData, err := ioutil.ReadFile("config.json")
+	configData, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		http.Error(w, "Failed to read configuration", http.StatusInternalServerError)
 		return
@@ -317,37 +499,101 @@ func UpdateConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate the new configuration
-	if newConfig.DestinationConfig.Type != "nfs" && newConfig.DestinationConfig.Type != "local" {
-		http.Error(w, "Invalid destination type", http.StatusBadRequest)
+	if err := validateConfig(newConfig); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if newConfig.Timezone == "" {
-		http.Error(w, "Timezone cannot be empty", http.StatusBadRequest)
+
+	// Save and reload the new configuration
+	if err := updateConfig(func(config *Config) error {
+		*config = newConfig
+		return nil
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Save the new configuration
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateConfig checks a configuration before it is saved.
+func validateConfig(config Config) error {
+	if err := validateDestination(config.DestinationConfig); err != nil {
+		return err
+	}
+	if config.Timezone == "" {
+		return fmt.Errorf("timezone cannot be empty")
+	}
+	if config.LogBackfill < 0 || config.LogRetentionDays < 0 {
+		return fmt.Errorf("log backfill and retention cannot be negative")
+	}
+	if err := validateProxyProfiles(config); err != nil {
+		return err
+	}
+	if err := validateCameraProfiles(config); err != nil {
+		return err
+	}
+	if err := validatePaths(config); err != nil {
+		return err
+	}
+	if err := validateStorage(config.Originals); err != nil {
+		return err
+	}
+	if err := validateSpace(config.FreeSpace); err != nil {
+		return err
+	}
+	paths := resolvePaths(config)
+	for label, sdCard := range config.SDCardMappings {
+		if !validClearPolicy(sdCard.ClearPolicy) {
+			return fmt.Errorf("invalid clear policy for %s: %s", label, sdCard.ClearPolicy)
+		}
+		if sdCard.Match != nil {
+			if err := sdCard.Match.validate(); err != nil {
+				return fmt.Errorf("invalid match rule for %s: %v", label, err)
+			}
+		}
+		if !validCollisionStrategy(sdCard.CollisionStrategy) {
+			return fmt.Errorf("invalid collision strategy for %s: %s", label, sdCard.CollisionStrategy)
+		}
+		if err := validateSourcePatterns(label, sdCard); err != nil {
+			return err
+		}
+		if err := validateBackups(label, sdCard, paths); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateConfig applies fn to the configuration file, validates and saves the result and reloads it in memory.
+func updateConfig(fn func(config *Config) error) error {
 	configLock.Lock()
 	defer configLock.Unlock()
 
-	configData, err := json.MarshalIndent(newConfig, "", "  ")
+	config, err := readConfig(configPath)
 	if err != nil {
-		http.Error(w, "Failed to serialize configuration", http.StatusInternalServerError)
-		return
+		return err
+	}
+	if err := fn(&config); err != nil {
+		return err
+	}
+	if err := validateConfig(config); err != nil {
+		return err
 	}
 
-	if err := ioutil.WriteFile("config.json", configData, 0644); err != nil {
-		http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
-		return
+	configData, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize configuration: %v", err)
+	}
+	if err := ioutil.WriteFile(configPath, configData, 0644); err != nil {
+		return fmt.Errorf("failed to save configuration: %v", err)
 	}
 
 	// Reload the configuration in memory
-	if err := loadConfig("config.json"); err != nil {
-		http.Error(w, "Failed to reload configuration", http.StatusInternalServerError)
-		return
+	if err := loadConfig(configPath); err != nil {
+		return fmt.Errorf("failed to reload configuration: %v", err)
 	}
-
-	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
 // StartServer starts the combined HTTP server for the REST API and web interface.
@@ -359,16 +605,30 @@ func StartServer() {
 	http.Handle("/favicon.ico", fs) // Serve favicon if needed
 
 	// Serve video proxies and other static files
-	http.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir("/media/nfs/video_archive"))))
+	http.Handle("/media/", http.StripPrefix("/media/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir(currentSettings().paths.MediaRoot)).ServeHTTP(w, r) // The media root can change when the configuration is saved
+	})))
 
 	// Serve WebSocket logs
 	http.HandleFunc("/ws/logs", logReceiver.HandleWebSocket)
 
 	// REST API routes
 	http.HandleFunc("/api/proxies", ListProxyFiles)
+	http.HandleFunc("/api/media", ListMedia)
+	http.HandleFunc("/api/media/rescan", RescanMedia)
+	http.HandleFunc("/api/logs", ListLogs)
+	http.HandleFunc("/api/devices", HandleDevices)
+	http.HandleFunc("/api/devices/", HandleDeviceAction)
+	http.HandleFunc("/api/devices/unknown", HandleUnknownDevices)
+	http.HandleFunc("/api/devices/unknown/", ClaimUnknownDevice)
 	http.HandleFunc("/api/destinations", HandleDestinations)
+	http.HandleFunc("/api/destination", HandleDestinationHealth)
+	http.HandleFunc("/api/original", ServeOriginal)
+	http.HandleFunc("/api/storage", HandleStorage)
 	http.HandleFunc("/api/move", MoveFiles)
 	http.HandleFunc("/api/reprocess", ReprocessProxies)
+	http.HandleFunc("/api/transcodes", HandleTranscodes)
+	http.HandleFunc("/api/transcodes/cancel", CancelTranscodes)
 	http.HandleFunc("/api/delete", DeleteVideo)
 	http.HandleFunc("/api/config", FetchConfig)
 	http.HandleFunc("/api/config/update", UpdateConfig)
@@ -383,6 +643,6 @@ func StartServer() {
 		}
 	})
 
-	logReceiver.Log("Starting server on :80")
+	logReceiver.Info("Starting server on :80")
 	log.Fatal(http.ListenAndServe(":80", nil))
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigGateDefersChangesDuringImports(t *testing.T) {
+	g := newConfigGate()
+	value := 1
+	if !g.apply(func() { value = 2 }) || value != 2 {
+		t.Fatal("configuration not applied while idle")
+	}
+
+	g.enter()
+	if g.apply(func() { value = 3 }) || value != 2 {
+		t.Fatal("configuration applied during an import")
+	}
+
+	// An import starting now waits for the change and then sees it
+	started := make(chan int)
+	go func() {
+		g.enter()
+		started <- value
+		g.leave()
+	}()
+	select {
+	case <-started:
+		t.Fatal("import started while a configuration change was pending")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	g.leave()
+	if seen := <-started; seen != 3 {
+		t.Fatalf("waiting import saw configuration %d, want 3", seen)
+	}
+}
@@ -25,7 +25,7 @@ node esbuild.js # Ensure the script is run from the correct directory
 # Step 3: Build the Go backend
 echo "Building Go backend..."
 cd backend
-GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o "../videoprocessor" main.go web.go sdcard.go
+GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o "../videoprocessor" .
 cd ..
 
 # Step 4: Prepare deployment directory
@@ -115,6 +115,7 @@ function App() {
               handleReprocessProxies={handleReprocessProxies}
               setDestination={setDestination}
               setNewFolder={setNewFolder}
+              fetchVideos={fetchVideos}
             />
           }
         />
@@ -1,10 +1,87 @@
 import React, { useEffect, useState, useRef } from "react";
+import { Button, Chip, LinearProgress } from "@mui/material";
+import UnknownDevices from "./UnknownDevices";
+
+// Format a number of seconds as m:ss or h:mm:ss
+const formatETA = (seconds) => {
+  const total = Math.max(0, Math.round(seconds));
+  const h = Math.floor(total / 3600);
+  const m = Math.floor((total % 3600) / 60);
+  const s = String(total % 60).padStart(2, "0");
+  return h > 0 ? `${h}:${String(m).padStart(2, "0")}:${s}` : `${m}:${s}`;
+};
+
+// Colors of the log levels, info uses the default text color
+const levelColors = {
+  debug: "#888",
+  warn: "#b26a00",
+  error: "#d32f2f",
+};
+
+// Chip colors of the device states, the working states use the default color
+const stateColors = {
+  done: "success",
+  failed: "error",
+  removed: "default",
+};
+
+// Format a byte count with a binary unit
+const formatBytes = (bytes) => {
+  const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+  let value = bytes;
+  let unit = 0;
+  while (value >= 1024 && unit < units.length - 1) {
+    value /= 1024;
+    unit += 1;
+  }
+  return `${value.toFixed(unit === 0 ? 0 : 1)} ${units[unit]}`;
+};
 
 function LogViewer({ onNewProxy }) {
   const [logs, setLogs] = useState([]);
+  const [progress, setProgress] = useState({}); // Active copies and transcodes keyed by kind, file and profile
+  const [devices, setDevices] = useState({}); // Card states keyed by label
+  const [unknownDevices, setUnknownDevices] = useState([]); // Connected cards without a mapping
+  const [destination, setDestination] = useState(null); // Health of the archive destination
+  const [volumes, setVolumes] = useState([]); // Capacity of the archive and backup destinations
   const socketRef = useRef(null); // Store the WebSocket instance
   const reconnectAttempts = useRef(0); // Track reconnection attempts
 
+  useEffect(() => {
+    fetch("/api/devices")
+      .then((res) => res.json())
+      .then((data) => {
+        const byLabel = {};
+        data.forEach((device) => {
+          byLabel[device.label] = device;
+        });
+        setDevices((prev) => ({ ...byLabel, ...prev }));
+      });
+    fetch("/api/devices/unknown")
+      .then((res) => res.json())
+      .then(setUnknownDevices);
+    fetch("/api/destination")
+      .then((res) => res.json())
+      .then(setDestination);
+  }, []);
+
+  // Refresh the capacity whenever the destination health changes
+  useEffect(() => {
+    fetch("/api/storage")
+      .then((res) => res.json())
+      .then(setVolumes);
+  }, [destination]);
+
+  // Run an action ("retry", "abandon" or "eject") on a card
+  const handleDeviceAction = async (label, action) => {
+    const response = await fetch(`/api/devices/${encodeURIComponent(label)}/${action}`, {
+      method: "POST",
+    });
+    if (!response.ok) {
+      alert(`Error running ${action} on ${label}: ${await response.text()}`);
+    }
+  };
+
   useEffect(() => {
     const connectWebSocket = () => {
       // Ensure no duplicate WebSocket connections
@@ -21,18 +98,51 @@ function LogViewer({ onNewProxy }) {
       };
 
       socket.onmessage = (event) => {
-        const logMessage = event.data;
+        const update = JSON.parse(event.data);
+
+        if (update.type === "progress") {
+          const key = `${update.kind}:${update.file}:${update.profile || ""}`;
+          setProgress((prev) => {
+            const next = { ...prev };
+            if (update.done) {
+              delete next[key];
+            } else {
+              next[key] = update;
+            }
+            return next;
+          });
+          return;
+        }
+        if (update.type === "device") {
+          setDevices((prev) => ({ ...prev, [update.label]: update }));
+          return;
+        }
+        if (update.type === "unknown-devices") {
+          setUnknownDevices(update.devices);
+          return;
+        }
+        if (update.type === "destination") {
+          setDestination(update.destination);
+          return;
+        }
+        if (update.type !== "log") {
+          return;
+        }
 
-        // Avoid adding duplicate log messages
+        // Avoid adding duplicate log events, the history is replayed on every reconnect
         setLogs((prevLogs) => {
-          if (prevLogs.includes(logMessage)) {
-            return prevLogs; // Skip duplicate messages
+          if (
+            prevLogs.some(
+              (log) => log.time === update.time && log.message === update.message
+            )
+          ) {
+            return prevLogs; // Skip duplicate events
           }
-          return [logMessage, ...prevLogs];
+          return [update, ...prevLogs];
         });
 
-        // Check if the log indicates a new proxy was created
-        if (logMessage.includes("Created proxy for")) {
+        // Check if the event indicates a new proxy was created
+        if (update.message.startsWith("Created proxy for")) {
           onNewProxy(); // Trigger the callback to refresh the video list
         }
       };
@@ -81,20 +191,104 @@ function LogViewer({ onNewProxy }) {
         whiteSpace: "pre-wrap", // Preserve whitespace and wrap long lines
       }}
     >
-      <h3>Server Logs</h3>
-      <div>
-        {logs.map((log, index) => {
-          const [timestamp, ...messageParts] = log.split("] ");
-          const message = messageParts.join("] "); // Rejoin in case the message contains "]"
-          return (
-            <div key={index} style={{ marginBottom: "10px" }}>
-              <div>{message}</div>
+      {destination && destination.checkedAt && (
+        <div style={{ marginBottom: "10px" }}>
+          <span>Destination {destination.path} </span>
+          <Chip
+            size="small"
+            label={destination.healthy ? "available" : "unavailable"}
+            color={destination.healthy ? "success" : "error"}
+          />
+          {destination.error && (
+            <div style={{ fontSize: "0.8em", color: "#d32f2f" }}>{destination.error}</div>
+          )}
+          {volumes.map((volume) => (
+            <div
+              key={volume.path}
+              style={{
+                fontSize: "0.8em",
+                color: volume.error || volume.freeBytes < volume.reserveBytes ? "#d32f2f" : "inherit",
+              }}
+            >
+              {volume.name}: {volume.error
+                ? volume.error
+                : `${formatBytes(volume.freeBytes)} free of ${formatBytes(volume.totalBytes)}`}
+            </div>
+          ))}
+        </div>
+      )}
+      <UnknownDevices devices={unknownDevices} />
+      {Object.keys(devices).length > 0 && (
+        <div>
+          <h3>Devices</h3>
+          {Object.values(devices).map((device) => (
+            <div key={device.label} style={{ marginBottom: "10px" }}>
+              <span>{device.label} </span>
+              <Chip
+                size="small"
+                label={device.state}
+                color={stateColors[device.state] || "primary"}
+              />
+              {["failed", "done"].includes(device.state) &&
+                device.connected &&
+                !device.running && (
+                  <Button size="small" onClick={() => handleDeviceAction(device.label, "retry")}>
+                    Retry
+                  </Button>
+                )}
+              {device.state === "failed" && !device.running && (
+                <Button size="small" onClick={() => handleDeviceAction(device.label, "abandon")}>
+                  Abandon job
+                </Button>
+              )}
+              {device.connected && device.state !== "ejecting" && (
+                <Button size="small" onClick={() => handleDeviceAction(device.label, "eject")}>
+                  Eject
+                </Button>
+              )}
+              {device.error && (
+                <div style={{ fontSize: "0.8em", color: "#d32f2f" }}>{device.error}</div>
+              )}
+            </div>
+          ))}
+        </div>
+      )}
+      {Object.keys(progress).length > 0 && (
+        <div>
+          <h3>In Progress</h3>
+          {Object.entries(progress).map(([key, item]) => (
+            <div key={key} style={{ marginBottom: "10px" }}>
+              <div>
+                {item.kind === "copy" ? "Copying" : `Transcoding (${item.profile})`}{" "}
+                {item.file.split("/").pop()}
+              </div>
+              <LinearProgress variant="determinate" value={item.percent} />
               <div style={{ fontSize: "0.8em", color: "#888" }}>
-                {timestamp.replace("[", "")}
+                {item.percent.toFixed(1)}%
+                {item.kind === "copy" &&
+                  ` · ${formatBytes(item.bytesDone)} of ${formatBytes(item.bytesTotal)}`}
+                {item.fps ? ` · ${item.fps.toFixed(1)} fps` : ""}
+                {item.etaSeconds ? ` · ETA ${formatETA(item.etaSeconds)}` : ""}
               </div>
             </div>
-          );
-        })}
+          ))}
+        </div>
+      )}
+      <h3>Server Logs</h3>
+      <div>
+        {logs.map((log, index) => (
+          <div key={index} style={{ marginBottom: "10px" }}>
+            <div style={{ color: levelColors[log.level] }}>
+              {log.level !== "info" && `${log.level.toUpperCase()}: `}
+              {log.message}
+            </div>
+            <div style={{ fontSize: "0.8em", color: "#888" }}>
+              {new Date(log.time).toLocaleString()}
+              {log.device && ` · ${log.device}`}
+              {log.stage && ` · ${log.stage}`}
+            </div>
+          </div>
+        ))}
       </div>
     </div>
   );
@@ -0,0 +1,86 @@
+import React, { useState } from "react";
+import { Box, Button, TextField, Typography } from "@mui/material";
+
+// Form to turn an unrecognized card into a new SD card mapping
+function ClaimForm({ device }) {
+  const [name, setName] = useState(device.block.label || "");
+  const [profile, setProfile] = useState("");
+  const [sourceDirs, setSourceDirs] = useState((device.sourceDirs || []).join(", "));
+  const [destination, setDestination] = useState("");
+
+  const handleClaim = async () => {
+    const payload = {
+      name,
+      profile,
+      sourceDirs: sourceDirs
+        .split(",")
+        .map((dir) => dir.trim())
+        .filter((dir) => dir),
+      destination,
+    };
+
+    const response = await fetch(
+      `/api/devices/unknown/${encodeURIComponent(device.block.uuid)}/claim`,
+      {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(payload),
+      }
+    );
+
+    if (!response.ok) {
+      alert(`Error claiming device: ${await response.text()}`);
+    }
+  };
+
+  return (
+    <Box style={{ marginBottom: "10px" }}>
+      <Typography>
+        {device.block.node} ({device.block.label || "no label"}, {device.block.uuid})
+      </Typography>
+      <TextField label="Name" value={name} onChange={(e) => setName(e.target.value)} size="small" />
+      <TextField
+        label="Camera profile"
+        value={profile}
+        onChange={(e) => setProfile(e.target.value)}
+        size="small"
+      />
+      <TextField
+        label="Source directories"
+        value={sourceDirs}
+        onChange={(e) => setSourceDirs(e.target.value)}
+        size="small"
+      />
+      <TextField
+        label="Destination"
+        value={destination}
+        onChange={(e) => setDestination(e.target.value)}
+        size="small"
+      />
+      <Button
+        variant="contained"
+        onClick={handleClaim}
+        disabled={!name || (!sourceDirs && !profile) || !destination}
+      >
+        Claim and Import
+      </Button>
+    </Box>
+  );
+}
+
+function UnknownDevices({ devices }) {
+  if (!devices.length) {
+    return null;
+  }
+
+  return (
+    <div>
+      <h3>Unclaimed Cards</h3>
+      {devices.map((device) => (
+        <ClaimForm key={device.block.uuid} device={device} />
+      ))}
+    </div>
+  );
+}
+
+export default UnknownDevices;
@@ -16,6 +16,7 @@ import {
   TextField,
 } from "@mui/material";
 import VideoPreview from "../components/VideoPreview";
+import LogViewer from "../components/LogViewer";
 
 function HomePage({
   videos,
@@ -29,6 +30,7 @@ function HomePage({
   handleReprocessProxies,
   setDestination,
   setNewFolder,
+  fetchVideos,
 }) {
   return (
     <Box>
@@ -112,6 +114,10 @@ function HomePage({
           Reprocess Proxies
         </Button>
       </Box>
+
+      <Box style={{ height: "400px" }}>
+        <LogViewer onNewProxy={fetchVideos} />
+      </Box>
     </Box>
   );
 }